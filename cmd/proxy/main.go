@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"http-reverse-proxy/internal/loadbalancer"
 	"http-reverse-proxy/internal/middleware"
 	"http-reverse-proxy/internal/proxy"
@@ -38,7 +39,7 @@ func main() {
 	}
 
 	// Initialize load balancer
-	lb, err := loadbalancer.NewRoundRobin(config, zapLogger)
+	lb, err := loadbalancer.New(config, zapLogger)
 	if err != nil {
 		zapLogger.Fatal("Failed to initialize load balancer", zap.Error(err))
 	}
@@ -49,14 +50,12 @@ func main() {
 		zapLogger.Fatal("Failed to initialize proxy", zap.Error(err))
 	}
 
-	// setup routes with handlers and middleware
+	// setup routes with handlers, CORS and rate limiting are applied per virtual host
 	router := proxyHandler.SetupRoutes()
 
 	loggingMiddleware := middleware.LoggingMiddleware(zapLogger)
-	corsMiddleware := middleware.CORSMiddleware(&config.CORS, zapLogger)
-	rateLimiterMiddleware := middleware.NewRateLimiter(&config.RateLimit, zapLogger).Middleware()
 
-	chainedHandler := middleware.Chain(router, loggingMiddleware, corsMiddleware, rateLimiterMiddleware)
+	chainedHandler := middleware.Chain(router, loggingMiddleware)
 
 	httpServer := &http.Server{
 		Addr:         config.Server.Address,
@@ -65,14 +64,45 @@ func main() {
 		WriteTimeout: config.Server.WriteTimeout,
 		IdleTimeout:  config.Server.IdleTimeout,
 	}
+	// Streams have no write timeout, end them so shutting down need not wait on them
+	httpServer.RegisterOnShutdown(proxyHandler.CloseStreams)
+	if httpServer.TLSConfig, err = utils.ServerTLSConfig(config.Server.TLS); err != nil {
+		zapLogger.Fatal("Failed to load TLS certificate", zap.Error(err))
+	}
+	// HTTP/3 serves the handler chain as is, the TCP listener adds Alt-Svc and h2c to it
+	h3Server, err := utils.EnableHTTP3(httpServer, config.Server.HTTP3)
+	if err != nil {
+		zapLogger.Fatal("Failed to enable HTTP/3", zap.Error(err))
+	}
+	if err := utils.EnableH2C(httpServer, config.Server.H2C); err != nil {
+		zapLogger.Fatal("Failed to enable h2c", zap.Error(err))
+	}
 
 	// start server in a goroutine
 	go func() {
-		zapLogger.Info("Starting server", zap.String("address", config.Server.Address))
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		zapLogger.Info("Starting server", zap.String("address", config.Server.Address), zap.Bool("tls", httpServer.TLSConfig != nil))
+		var err error
+		if httpServer.TLSConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			zapLogger.Fatal("ListenAndServe error:", zap.Error(err))
 		}
 	}()
 
-	server.GracefulShutdown(httpServer, zapLogger)
+	drains := []func(context.Context) error{proxyHandler.Shutdown}
+	if h3Server != nil {
+		go func() {
+			zapLogger.Info("Starting HTTP/3 server", zap.String("address", h3Server.Addr))
+			if err := h3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				zapLogger.Fatal("HTTP/3 ListenAndServe error:", zap.Error(err))
+			}
+		}()
+		drains = append([]func(context.Context) error{h3Server.Shutdown}, drains...)
+	}
+
+	server.GracefulShutdown(httpServer, zapLogger, drains...)
+	proxyHandler.Close()
 }
@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Circuit breaker states reported in BackendStatus
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+const (
+	defaultBreakerErrorRatio      = 0.5
+	defaultBreakerMinimumRequests = 20
+	defaultBreakerWindow          = 10 * time.Second
+	defaultBreakerOpenDuration    = 30 * time.Second
+	defaultBreakerHalfOpenProbes  = 1
+)
+
+// circuitBreaker stops sending traffic to a backend whose error ratio gets
+// too high. While closed it counts requests over a rolling window; once the
+// error ratio trips it opens and rejects the backend for open_duration. After
+// that a limited number of probe requests are let through in the half-open
+// state: if they all succeed the breaker closes, a single failure reopens it.
+type circuitBreaker struct {
+	config  models.CircuitBreakerConfig
+	backend string
+	logger  *zap.Logger
+
+	mu             sync.Mutex
+	state          string
+	windowStart    time.Time
+	requests       int
+	failures       int
+	openedAt       time.Time
+	probesInFlight int
+	probeSuccesses int
+	// generation counts the half-open rounds, probes carry the round they were admitted in
+	generation uint64
+}
+
+func newCircuitBreaker(config models.CircuitBreakerConfig, backend string, logger *zap.Logger) *circuitBreaker {
+	if config.ErrorRatio <= 0 {
+		config.ErrorRatio = defaultBreakerErrorRatio
+	}
+	if config.MinimumRequests <= 0 {
+		config.MinimumRequests = defaultBreakerMinimumRequests
+	}
+	if config.Window <= 0 {
+		config.Window = defaultBreakerWindow
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = defaultBreakerOpenDuration
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = defaultBreakerHalfOpenProbes
+	}
+
+	return &circuitBreaker{
+		config:      config,
+		backend:     backend,
+		logger:      logger,
+		state:       CircuitClosed,
+		windowStart: time.Now(),
+	}
+}
+
+// ready reports whether a new request could be let through, without claiming a probe slot
+func (cb *circuitBreaker) ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		return time.Since(cb.openedAt) >= cb.config.OpenDuration
+	case CircuitHalfOpen:
+		return cb.probesInFlight < cb.config.HalfOpenProbes
+	default:
+		return true
+	}
+}
+
+// acquire is called when the backend is picked. It turns an expired open
+// breaker half-open and claims a probe slot while half-open, returning false
+// when the breaker no longer lets the request through. Probes get the
+// half-open round they belong to, every other request gets zero.
+func (cb *circuitBreaker) acquire() (uint64, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.config.OpenDuration {
+			return 0, false
+		}
+		cb.transition(CircuitHalfOpen)
+		cb.generation++
+		cb.probesInFlight = 0
+		cb.probeSuccesses = 0
+	case CircuitHalfOpen:
+		if cb.probesInFlight >= cb.config.HalfOpenProbes {
+			return 0, false
+		}
+	default:
+		return 0, true
+	}
+
+	cb.probesInFlight++
+	return cb.generation, true
+}
+
+// record counts the outcome of a request admitted by acquire, probe is the value acquire returned
+func (cb *circuitBreaker) record(outcome Outcome, probe uint64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	failed := isFailure(outcome)
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if probe != cb.generation {
+			// Admitted before this round started, it says nothing about the backend now
+			return
+		}
+		cb.probesInFlight--
+		if outcome.Canceled() {
+			// An abandoned probe proves nothing either way
+			return
+		}
+		if failed {
+			cb.open()
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.config.HalfOpenProbes {
+			cb.transition(CircuitClosed)
+			cb.resetWindow(time.Now())
+		}
+
+	case CircuitClosed:
+		if outcome.Canceled() {
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(cb.windowStart) >= cb.config.Window {
+			cb.resetWindow(now)
+		}
+
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.config.MinimumRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.config.ErrorRatio {
+			cb.open()
+		}
+
+	case CircuitOpen:
+		// Requests still in flight when the breaker opened are ignored
+	}
+}
+
+// release frees the probe slot of a request admitted by acquire without counting its outcome
+func (cb *circuitBreaker) release(probe uint64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen && probe == cb.generation {
+		cb.probesInFlight--
+	}
+}
+
+func (cb *circuitBreaker) current() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// open must be called with mu held
+func (cb *circuitBreaker) open() {
+	cb.openedAt = time.Now()
+	cb.transition(CircuitOpen)
+}
+
+// resetWindow must be called with mu held
+func (cb *circuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+}
+
+// transition must be called with mu held
+func (cb *circuitBreaker) transition(state string) {
+	if cb.state == state {
+		return
+	}
+
+	cb.logger.Warn("Circuit breaker state changed",
+		zap.String("backend", cb.backend),
+		zap.String("from", cb.state),
+		zap.String("to", state),
+		zap.Int("requests", cb.requests),
+		zap.Int("failures", cb.failures))
+	cb.state = state
+}
@@ -0,0 +1,179 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"http-reverse-proxy/pkg/models"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Supported values for load_balancing.hash.key
+const (
+	HashKeyHeader   = "header"
+	HashKeyCookie   = "cookie"
+	HashKeyPath     = "path"
+	HashKeyQuery    = "query"
+	HashKeyClientIP = "client_ip"
+)
+
+const defaultVirtualNodes = 160
+
+// ConsistentHash maps a key taken from the request onto a hash ring so the
+// same key keeps landing on the same backend. Each backend owns many virtual
+// nodes on the ring; when one becomes unhealthy its keys move to the next
+// healthy node while every other key stays put.
+type ConsistentHash struct {
+	*pool
+	config models.HashConfig
+	ring   []ringNode
+	next   atomic.Uint64
+}
+
+type ringNode struct {
+	hash    uint64
+	backend *Backend
+}
+
+func NewConsistentHash(config *models.Config, logger *zap.Logger) (*ConsistentHash, error) {
+	hashConfig := config.LoadBalancing.Hash
+	switch hashConfig.Key {
+	case HashKeyHeader, HashKeyCookie, HashKeyQuery:
+		if hashConfig.Name == "" {
+			return nil, fmt.Errorf("load_balancing.hash.name is required for the %s key", hashConfig.Key)
+		}
+	case HashKeyPath:
+		if hashConfig.Segment <= 0 {
+			return nil, errors.New("load_balancing.hash.segment must be positive for the path key")
+		}
+	case HashKeyClientIP:
+	default:
+		return nil, fmt.Errorf("unknown load_balancing.hash.key %q", hashConfig.Key)
+	}
+
+	p, err := newPool(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	virtualNodes := hashConfig.VirtualNodes
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	// Virtual nodes are derived from the backend URL only, so a backend keeps
+	// its place on the ring when others are added or removed
+	ring := make([]ringNode, 0, len(p.backends)*virtualNodes)
+	for _, backend := range p.backends {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringNode{
+				hash:    hashKey(backend.URL.String() + "#" + strconv.Itoa(i)),
+				backend: backend,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	return &ConsistentHash{
+		pool:   p,
+		config: hashConfig,
+		ring:   ring,
+	}, nil
+}
+
+func (ch *ConsistentHash) NextBackend(r *http.Request) (*Backend, Ticket, error) {
+	key, ok := ch.requestKey(r)
+	if !ok {
+		// Requests without a key have nothing to stick to, spread them evenly instead
+		return ch.fallback(r)
+	}
+
+	// Walk clockwise from the key's position until a healthy backend owns the node
+	h := hashKey(key)
+	start := sort.Search(len(ch.ring), func(i int) bool { return ch.ring[i].hash >= h })
+	// A backend whose breaker turns the request away is passed over like an unhealthy one
+	var refused []*Backend
+	for i := 0; i < len(ch.ring); i++ {
+		node := ch.ring[(start+i)%len(ch.ring)]
+		if !eligible(r, node.backend) || slices.Contains(refused, node.backend) {
+			continue
+		}
+		backend, ticket, err := ch.acquire(node.backend)
+		if errors.Is(err, errCircuitOpen) {
+			refused = append(refused, node.backend)
+			continue
+		}
+		return backend, ticket, err
+	}
+
+	return nil, Ticket{}, noBackend(len(refused) > 0)
+}
+
+func (ch *ConsistentHash) fallback(r *http.Request) (*Backend, Ticket, error) {
+	numBackends := uint64(len(ch.backends))
+	start := ch.next.Add(1)
+	refused := false
+	for i := uint64(0); i < numBackends; i++ {
+		backend := ch.backends[(start+i)%numBackends]
+		if !eligible(r, backend) {
+			continue
+		}
+		picked, ticket, err := ch.acquire(backend)
+		if errors.Is(err, errCircuitOpen) {
+			refused = true
+			continue
+		}
+		return picked, ticket, err
+	}
+
+	return nil, Ticket{}, noBackend(refused)
+}
+
+// requestKey extracts the configured hash key, ok is false when the request does not carry one
+func (ch *ConsistentHash) requestKey(r *http.Request) (string, bool) {
+	var key string
+	switch ch.config.Key {
+	case HashKeyHeader:
+		key = r.Header.Get(ch.config.Name)
+	case HashKeyCookie:
+		if cookie, err := r.Cookie(ch.config.Name); err == nil {
+			key = cookie.Value
+		}
+	case HashKeyQuery:
+		key = r.URL.Query().Get(ch.config.Name)
+	case HashKeyPath:
+		segments := strings.FieldsFunc(r.URL.Path, func(c rune) bool { return c == '/' })
+		if ch.config.Segment <= len(segments) {
+			key = segments[ch.config.Segment-1]
+		}
+	case HashKeyClientIP:
+		key = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			key = host
+		}
+	}
+	return key, key != ""
+}
+
+// hashKey hashes with FNV-1a and runs the result through a 64-bit finalizer,
+// FNV alone clusters similar inputs such as "backend#1" and "backend#2"
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	h := hasher.Sum64()
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,272 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/pkg/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckPath    = "/health"
+	defaultHealthCheckTimeout = 5 * time.Second
+
+	// maxHealthCheckBody caps how much of a health check response is searched for body_contains
+	maxHealthCheckBody = 64 << 10
+)
+
+// statusRange is an inclusive range of HTTP status codes
+type statusRange struct {
+	min, max int
+}
+
+// healthChecker actively polls backends and only flips their state after a
+// configurable number of consecutive passes or failures
+type healthChecker struct {
+	client             *http.Client
+	h2cClient          *http.Client
+	frequency          time.Duration
+	path               string
+	healthyThreshold   int
+	unhealthyThreshold int
+	expectedStatuses   []statusRange
+	bodyContains       string
+	grpc               bool
+	grpcService        string
+	logger             *zap.Logger
+}
+
+func newHealthChecker(config models.HealthCheckConfig, tlsConfig models.UpstreamTLSConfig, logger *zap.Logger) (*healthChecker, error) {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	path := config.Path
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	expectedStatuses, err := parseStatusRanges(config.ExpectedStatuses)
+	if err != nil {
+		return nil, err
+	}
+
+	// Probe https backends with the same trust settings as proxied requests
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.TLSClientConfig, err = utils.UpstreamTLSConfig(tlsConfig); err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	return &healthChecker{
+		client:             &http.Client{Timeout: timeout, Transport: transport},
+		h2cClient:          &http.Client{Timeout: timeout, Transport: utils.H2CTransport(dialer)},
+		frequency:          config.Frequency,
+		path:               path,
+		healthyThreshold:   max(config.HealthyThreshold, 1),
+		unhealthyThreshold: max(config.UnhealthyThreshold, 1),
+		expectedStatuses:   expectedStatuses,
+		bodyContains:       config.BodyContains,
+		grpc:               config.GRPC,
+		grpcService:        config.GRPCService,
+		logger:             logger,
+	}, nil
+}
+
+// parseStatusRanges turns entries such as "200", "2xx" or "200-399" into ranges, defaulting to 200 only
+func parseStatusRanges(entries []string) ([]statusRange, error) {
+	if len(entries) == 0 {
+		return []statusRange{{http.StatusOK, http.StatusOK}}, nil
+	}
+
+	ranges := make([]statusRange, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(strings.ToLower(entry))
+
+		if len(entry) == 3 && strings.HasSuffix(entry, "xx") {
+			class, err := strconv.Atoi(entry[:1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid health_check.expected_statuses entry %q", entry)
+			}
+			ranges = append(ranges, statusRange{class * 100, class*100 + 99})
+			continue
+		}
+
+		low, high, isRange := strings.Cut(entry, "-")
+		lowCode, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check.expected_statuses entry %q", entry)
+		}
+		highCode := lowCode
+		if isRange {
+			if highCode, err = strconv.Atoi(high); err != nil || highCode < lowCode {
+				return nil, fmt.Errorf("invalid health_check.expected_statuses entry %q", entry)
+			}
+		}
+		ranges = append(ranges, statusRange{lowCode, highCode})
+	}
+	return ranges, nil
+}
+
+func (hc *healthChecker) run(backends []*Backend) {
+	ticker := time.NewTicker(hc.frequency)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, backend := range backends {
+			hc.record(backend, hc.check(backend))
+		}
+	}
+}
+
+// record tracks consecutive results and changes state once a threshold is crossed
+func (hc *healthChecker) record(backend *Backend, passed bool) {
+	if passed {
+		backend.passes++
+		backend.failures = 0
+		if !backend.Healthy() && backend.passes >= hc.healthyThreshold {
+			backend.healthy.Store(true)
+			hc.logger.Info("Backend marked as healthy",
+				zap.String("backend", backend.URL.Host),
+				zap.Int("consecutive_passes", backend.passes))
+		}
+		return
+	}
+
+	backend.failures++
+	backend.passes = 0
+	if backend.Healthy() && backend.failures >= hc.unhealthyThreshold {
+		backend.healthy.Store(false)
+		// observability
+		hc.logger.Warn("Backend marked as unhealthy",
+			zap.String("backend", backend.URL.Host),
+			zap.Int("consecutive_failures", backend.failures))
+	}
+}
+
+// check runs a single probe against the backend
+func (hc *healthChecker) check(backend *Backend) bool {
+	target := *backend.URL
+	target.Scheme = utils.RequestScheme(backend.URL)
+	// A backend served under a base path has its health endpoint there too
+	target.Path = strings.TrimSuffix(backend.URL.Path, "/") + "/" + strings.TrimPrefix(hc.path, "/")
+	target.RawPath = ""
+	target.RawQuery = ""
+
+	client := hc.client
+	if backend.URL.Scheme == utils.SchemeH2C {
+		client = hc.h2cClient
+	}
+	if hc.grpc {
+		return hc.checkGRPC(client, target)
+	}
+
+	resp, err := client.Get(target.String())
+	if err != nil {
+		hc.logger.Error("Health check request failed", zap.String("backend", target.String()), zap.Error(err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	if !hc.statusExpected(resp.StatusCode) {
+		hc.logger.Debug("Health check returned unexpected status",
+			zap.String("backend", target.String()),
+			zap.Int("status", resp.StatusCode))
+		return false
+	}
+
+	if hc.bodyContains == "" {
+		return true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		hc.logger.Error("Failed to read health check response", zap.String("backend", target.String()), zap.Error(err))
+		return false
+	}
+	return strings.Contains(string(body), hc.bodyContains)
+}
+
+func (hc *healthChecker) statusExpected(status int) bool {
+	for _, r := range hc.expectedStatuses {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGRPC calls grpc.health.v1.Health/Check on the backend at target and
+// passes if it answers SERVING with an OK status
+func (hc *healthChecker) checkGRPC(client *http.Client, target url.URL) bool {
+	target.Path = "/grpc.health.v1.Health/Check"
+
+	// HealthCheckRequest has the service name as field 1, framed uncompressed
+	var message []byte
+	if hc.grpcService != "" {
+		message = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(hc.grpcService)))...)
+		message = append(message, hc.grpcService...)
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(frame))
+	if err != nil {
+		hc.logger.Error("Health check request failed", zap.String("backend", target.String()), zap.Error(err))
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		hc.logger.Error("Health check request failed", zap.String("backend", target.String()), zap.Error(err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		hc.logger.Error("Failed to read health check response", zap.String("backend", target.String()), zap.Error(err))
+		return false
+	}
+
+	// Errors come as trailers, or in the headers of a response without a body
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if resp.StatusCode != http.StatusOK || status != "0" {
+		hc.logger.Debug("Health check returned unexpected status",
+			zap.String("backend", target.String()),
+			zap.Int("status", resp.StatusCode),
+			zap.String("grpc_status", status))
+		return false
+	}
+
+	// HealthCheckResponse has the serving status as field 1, SERVING is 1
+	if len(body) < 5 {
+		return false
+	}
+	message = body[5:]
+	if len(message) < 2 || message[0] != 0x08 {
+		return false
+	}
+	serving, n := binary.Uvarint(message[1:])
+	return n > 0 && serving == 1
+}
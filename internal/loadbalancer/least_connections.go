@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"errors"
+	"http-reverse-proxy/pkg/models"
+	"net/http"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// LeastConnections sends each request to the healthy backend with the fewest
+// requests in flight. Ties are broken round robin so idle pools still rotate.
+type LeastConnections struct {
+	*pool
+	next int
+	mu   sync.Mutex
+}
+
+func NewLeastConnections(config *models.Config, logger *zap.Logger) (*LeastConnections, error) {
+	p, err := newPool(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LeastConnections{pool: p}, nil
+}
+
+func (lc *LeastConnections) NextBackend(r *http.Request) (*Backend, Ticket, error) {
+	// Held until the pick is acquired so concurrent requests see each other's counts
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	numBackends := len(lc.backends)
+	if numBackends == 0 {
+		return nil, Ticket{}, errors.New("no backends available")
+	}
+
+	// Scan starting from a rotating offset, the first backend seen wins a tie
+	candidates := make([]*Backend, 0, numBackends)
+	for i := 0; i < numBackends; i++ {
+		backend := lc.backends[(lc.next+i)%numBackends]
+		if eligible(r, backend) {
+			candidates = append(candidates, backend)
+		}
+	}
+	lc.next = (lc.next + 1) % numBackends
+
+	// A breaker that turns the request away only rules out its backend, the next least loaded is tried
+	refused := false
+	for len(candidates) > 0 {
+		best := 0
+		for i, backend := range candidates {
+			if backend.InFlight() < candidates[best].InFlight() {
+				best = i
+			}
+		}
+
+		picked, ticket, err := lc.acquire(candidates[best])
+		if errors.Is(err, errCircuitOpen) {
+			refused = true
+			candidates = slices.Delete(candidates, best, best+1)
+			continue
+		}
+		return picked, ticket, err
+	}
+
+	return nil, Ticket{}, noBackend(refused)
+}
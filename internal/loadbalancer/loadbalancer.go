@@ -1,129 +1,158 @@
 package loadbalancer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"http-reverse-proxy/pkg/models"
 	"net/http"
-	"net/url"
-	"strings"
-	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-type RoundRobin struct {
-	backends        []*url.URL
-	current         int
-	mu              sync.Mutex
-	config          *models.Config
-	healthCheckFreq time.Duration
-	healthStatus    map[string]bool
-	logger          *zap.Logger
-}
-
-func NewRoundRobin(config *models.Config, logger *zap.Logger) (*RoundRobin, error) {
-	backendURLs := config.Backends
-	backends := make([]*url.URL, 0, len(backendURLs))
+// Supported values for load_balancing.strategy
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastConnections   = "least_connections"
+	StrategyPowerOfTwoChoices  = "p2c"
+	StrategyConsistentHash     = "consistent_hash"
+)
 
-	// Parse backend URLs
-	for _, urlStr := range backendURLs {
-		backendURL, err := url.Parse(urlStr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid backend URL %s: %w", urlStr, err)
-		}
-		backends = append(backends, backendURL)
-	}
+// Balancer picks a backend for each proxied request and keeps track of the
+// state of the backends it manages.
+type Balancer interface {
+	// NextBackend picks the backend that should serve r, the ticket must be
+	// passed back in the request's Outcome
+	NextBackend(r *http.Request) (*Backend, Ticket, error)
+	// Report records the outcome of a request previously sent to b, it must be
+	// called exactly once for every backend returned by NextBackend
+	Report(b *Backend, outcome Outcome)
+	// Release is called instead of Report for requests whose outcome says
+	// nothing about b, it gives back what NextBackend took without judging b
+	Release(b *Backend, ticket Ticket)
+	// Backends lists every backend in the pool along with its current state
+	Backends() []BackendStatus
+}
 
-	if len(backends) == 0 {
-		return nil, errors.New("no backends provided")
-	}
+// Outcome describes the result of a request sent to a backend. StatusCode is
+// zero when no response was received, in which case Err says why.
+type Outcome struct {
+	StatusCode int
+	Err        error
+	Duration   time.Duration
+	// Ticket is the one NextBackend handed out along with the backend
+	Ticket Ticket
+}
 
-	rr := &RoundRobin{
-		backends:        backends,
-		current:         0,
-		config:          config,
-		healthStatus:    make(map[string]bool),
-		healthCheckFreq: config.HealthCheck.Frequency,
-		logger:          logger,
-	}
+// Ticket ties a request to the circuit breaker round it was admitted in, so
+// that only the probes of a half-open breaker decide whether it closes again
+type Ticket struct {
+	probe uint64
+}
 
-	// Initial health check
-	for _, backend := range rr.backends {
-		rr.healthStatus[backend.Host] = checkBackendHealth(backend.String(), logger)
-	}
+var errCircuitOpen = errors.New("circuit breaker is open")
 
-	// Ensure at least one backend is healthy
-	logger.Info("Ensuring at least one backend is healthy")
-	healthy := false
-	for _, status := range rr.healthStatus {
-		if status {
-			healthy = true
-			break
-		}
-	}
-	if !healthy {
-		return nil, errors.New("no healthy backends available on startup")
+// noBackend is the error for a pick that came up empty, errCircuitOpen when
+// there were eligible backends but their breakers turned the request away
+func noBackend(refused bool) error {
+	if refused {
+		return errCircuitOpen
 	}
-
-	// Start periodic health checks
-	go rr.healthChecker()
-
-	return rr, nil
+	return errors.New("no healthy backends available")
 }
 
-// Check for next available backend end
-func (rr *RoundRobin) NextBackend() (*url.URL, error) {
-	rr.mu.Lock()
-	defer rr.mu.Unlock()
+// Canceled reports whether the request was abandoned by the client or the proxy,
+// for example a losing hedged request, rather than failed by the backend. Such
+// outcomes say nothing about the health of the backend.
+func (o Outcome) Canceled() bool {
+	return errors.Is(o.Err, context.Canceled)
+}
 
-	numBackends := len(rr.backends)
-	if numBackends == 0 {
-		return nil, errors.New("no backends available")
-	}
+// BackendStatus is a point-in-time snapshot of a backend, used for observability
+type BackendStatus struct {
+	URL     string `json:"url"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+	// CircuitState is closed, open or half_open, omitted when circuit breaking is disabled
+	CircuitState string `json:"circuit_state,omitempty"`
+	InFlight     int64  `json:"in_flight"`
+}
 
-	// loop through all backends and find first available one in RR, exist if none is available
-	for i := 0; i < numBackends; i++ {
-		backend := rr.backends[rr.current]
-		rr.current = (rr.current + 1) % numBackends
+type excludedKey struct{}
 
-		if rr.healthStatus[backend.Host] {
-			return backend, nil
-		}
+// WithExcluded returns a context that keeps NextBackend from picking any of the
+// given backends, used to send a retry somewhere other than where it failed
+func WithExcluded(ctx context.Context, backends ...*Backend) context.Context {
+	if len(backends) == 0 {
+		return ctx
 	}
-
-	return nil, errors.New("no healthy backends available")
+	return context.WithValue(ctx, excludedKey{}, backends)
 }
 
-func (rr *RoundRobin) healthChecker() {
-	ticker := time.NewTicker(rr.healthCheckFreq)
-	defer ticker.Stop()
-	for range ticker.C {
-		for _, backend := range rr.backends {
-			healthy := checkBackendHealth(backend.Host, rr.logger)
-			rr.mu.Lock()
-			rr.healthStatus[backend.Host] = healthy
-			rr.mu.Unlock()
-			if !healthy {
-				// observability
-				rr.logger.Warn("Backend marked as unhealthy", zap.String("backend", backend.Host))
-			}
+// eligible reports whether b can take r, i.e. it is available and not excluded for this request
+func eligible(r *http.Request, b *Backend) bool {
+	if !b.Available() {
+		return false
+	}
+	excluded, _ := r.Context().Value(excludedKey{}).([]*Backend)
+	for _, e := range excluded {
+		if e == b {
+			return false
 		}
 	}
+	return true
 }
 
-func checkBackendHealth(backend string, logger *zap.Logger) bool {
+// New builds the balancer selected by config.LoadBalancing.Strategy, defaulting to round robin,
+// and layers sticky sessions on top when they are enabled
+func New(config *models.Config, logger *zap.Logger) (Balancer, error) {
+	balancer, err := newStrategy(config, logger)
+	if err != nil {
+		return nil, err
+	}
 
-	if !strings.HasPrefix(backend, "http://") && !strings.HasPrefix(backend, "https://") {
-		backend = "http://" + backend
+	if config.LoadBalancing.Sticky.Enabled {
+		return newStickySessions(balancer, config.LoadBalancing.Sticky)
 	}
+	return balancer, nil
+}
 
-	resp, err := http.Get(backend + "/health")
-	if err != nil {
-		logger.Error("Health check request failed", zap.String("backend", backend), zap.Error(err))
-		return false
+func newStrategy(config *models.Config, logger *zap.Logger) (Balancer, error) {
+	switch config.LoadBalancing.Strategy {
+	case "", StrategyRoundRobin:
+		rr, err := NewRoundRobin(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return rr, nil
+	case StrategyWeightedRoundRobin:
+		wrr, err := NewWeightedRoundRobin(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return wrr, nil
+	case StrategyLeastConnections:
+		lc, err := NewLeastConnections(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return lc, nil
+	case StrategyPowerOfTwoChoices:
+		p2c, err := NewPowerOfTwoChoices(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return p2c, nil
+	case StrategyConsistentHash:
+		ch, err := NewConsistentHash(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		return ch, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", config.LoadBalancing.Strategy)
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
 }
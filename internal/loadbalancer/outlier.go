@@ -0,0 +1,187 @@
+package loadbalancer
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultOutlierMinRequests  = 10
+	defaultOutlierInterval     = 10 * time.Second
+	defaultBaseEjectionTime    = 30 * time.Second
+	defaultMaxEjectionTime     = 5 * time.Minute
+	defaultMaxEjectionPercent  = 50
+)
+
+// outlierDetector ejects backends based on the results of live traffic. A
+// backend is ejected after too many consecutive failures or when its failure
+// rate over an interval crosses a threshold. Each ejection of the same backend
+// lasts longer than the last, and the streak is forgiven one step for every
+// clean interval.
+type outlierDetector struct {
+	config   models.OutlierDetectionConfig
+	backends []*Backend
+	stats    map[*Backend]*outlierStats
+	logger   *zap.Logger
+
+	// ejectMu makes checking the pool and ejecting one step, so backends that
+	// fail at the same time cannot all slip under max_ejection_percent
+	ejectMu sync.Mutex
+}
+
+type outlierStats struct {
+	mu                  sync.Mutex
+	consecutiveFailures int
+	windowStart         time.Time
+	requests            int
+	failures            int
+	ejections           int
+	ejectedInWindow     bool
+}
+
+func newOutlierDetector(config models.OutlierDetectionConfig, backends []*Backend, logger *zap.Logger) *outlierDetector {
+	if config.ConsecutiveFailures <= 0 {
+		config.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if config.MinimumRequests <= 0 {
+		config.MinimumRequests = defaultOutlierMinRequests
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultOutlierInterval
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	// Built once and only read afterwards, so it is safe to share without locking
+	stats := make(map[*Backend]*outlierStats, len(backends))
+	now := time.Now()
+	for _, backend := range backends {
+		stats[backend] = &outlierStats{windowStart: now}
+	}
+
+	return &outlierDetector{
+		config:   config,
+		backends: backends,
+		stats:    stats,
+		logger:   logger,
+	}
+}
+
+// isFailure treats connection errors, timeouts and 5xx responses as failures
+func isFailure(outcome Outcome) bool {
+	if outcome.StatusCode == 0 {
+		return outcome.Err != nil
+	}
+	return outcome.StatusCode >= http.StatusInternalServerError
+}
+
+func (od *outlierDetector) record(b *Backend, outcome Outcome) {
+	stats := od.stats[b]
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(stats.windowStart) >= od.config.Interval {
+		// A clean interval forgives one step of the ejection streak
+		if !stats.ejectedInWindow && !b.Ejected() && stats.ejections > 0 {
+			stats.ejections--
+		}
+		stats.windowStart = now
+		stats.requests = 0
+		stats.failures = 0
+		stats.ejectedInWindow = false
+	}
+
+	// Requests that were already in flight when the backend got ejected should not extend it
+	if b.Ejected() || outcome.Canceled() {
+		return
+	}
+
+	stats.requests++
+	if !isFailure(outcome) {
+		stats.consecutiveFailures = 0
+		return
+	}
+	stats.failures++
+	stats.consecutiveFailures++
+
+	reason := ""
+	switch {
+	case stats.consecutiveFailures >= od.config.ConsecutiveFailures:
+		reason = "consecutive_failures"
+	case od.config.FailureRateThreshold > 0 &&
+		stats.requests >= od.config.MinimumRequests &&
+		float64(stats.failures)/float64(stats.requests) >= od.config.FailureRateThreshold:
+		reason = "failure_rate"
+	default:
+		return
+	}
+
+	duration := od.config.BaseEjectionTime * time.Duration(stats.ejections+1)
+	if duration > od.config.MaxEjectionTime {
+		duration = od.config.MaxEjectionTime
+	}
+	if !od.eject(b, now.Add(duration)) {
+		od.logger.Warn("Outlier detected but max ejection percent reached",
+			zap.String("backend", b.URL.Host),
+			zap.String("reason", reason))
+		return
+	}
+
+	stats.ejections++
+	stats.ejectedInWindow = true
+	stats.consecutiveFailures = 0
+	stats.requests = 0
+	stats.failures = 0
+
+	od.logger.Warn("Backend ejected by outlier detection",
+		zap.String("backend", b.URL.Host),
+		zap.String("reason", reason),
+		zap.Int("ejections", stats.ejections),
+		zap.Duration("duration", duration))
+}
+
+// eject takes b out until the given time, unless canEject says the pool cannot spare it
+func (od *outlierDetector) eject(b *Backend, until time.Time) bool {
+	od.ejectMu.Lock()
+	defer od.ejectMu.Unlock()
+
+	if !od.canEject() {
+		return false
+	}
+	b.ejectedUntil.Store(until.UnixNano())
+	return true
+}
+
+// canEject keeps at least one backend available and the ejected share within
+// max_ejection_percent, it must be called with ejectMu held
+func (od *outlierDetector) canEject() bool {
+	ejected, available := 0, 0
+	for _, backend := range od.backends {
+		if backend.Ejected() {
+			ejected++
+		} else if backend.Healthy() {
+			available++
+		}
+	}
+
+	if available <= 1 {
+		return false
+	}
+
+	// One ejection is always allowed so small pools can still shed a bad backend
+	allowed := max(len(od.backends)*od.config.MaxEjectionPercent/100, 1)
+	return ejected < allowed
+}
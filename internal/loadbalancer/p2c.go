@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"errors"
+	"http-reverse-proxy/pkg/models"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultEWMADecay is how long it takes for an old latency sample to lose most of its weight
+	defaultEWMADecay = 10 * time.Second
+
+	// failurePenalty is recorded instead of the real latency when a request fails,
+	// so a backend that fails fast does not look attractive
+	failurePenalty = time.Second
+)
+
+// PowerOfTwoChoices samples two healthy backends at random and picks the one
+// with the lower load score. The score multiplies an exponentially weighted
+// moving average of response latency by the number of requests in flight.
+// Random sampling avoids a global lock and keeps a single fast backend from
+// being stampeded the way a strict "pick the best" strategy would.
+type PowerOfTwoChoices struct {
+	*pool
+	decay     time.Duration
+	latencies map[*Backend]*ewma
+}
+
+func NewPowerOfTwoChoices(config *models.Config, logger *zap.Logger) (*PowerOfTwoChoices, error) {
+	p, err := newPool(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	decay := config.LoadBalancing.EWMADecay
+	if decay <= 0 {
+		decay = defaultEWMADecay
+	}
+
+	// Built once and only read afterwards, so it is safe to share without locking
+	latencies := make(map[*Backend]*ewma, len(p.backends))
+	for _, backend := range p.backends {
+		latencies[backend] = &ewma{}
+	}
+
+	return &PowerOfTwoChoices{
+		pool:      p,
+		decay:     decay,
+		latencies: latencies,
+	}, nil
+}
+
+func (p2c *PowerOfTwoChoices) NextBackend(r *http.Request) (*Backend, Ticket, error) {
+	healthy := make([]*Backend, 0, len(p2c.backends))
+	for _, backend := range p2c.backends {
+		if eligible(r, backend) {
+			healthy = append(healthy, backend)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil, Ticket{}, errors.New("no healthy backends available")
+	}
+
+	// A breaker that turns the request away only rules out its backend, the choice is made again without it
+	for len(healthy) > 0 {
+		pick := 0
+		if len(healthy) > 1 {
+			// Pick two distinct backends
+			i := rand.IntN(len(healthy))
+			j := rand.IntN(len(healthy) - 1)
+			if j >= i {
+				j++
+			}
+
+			pick = i
+			if p2c.score(healthy[j]) < p2c.score(healthy[i]) {
+				pick = j
+			}
+		}
+
+		backend, ticket, err := p2c.acquire(healthy[pick])
+		if !errors.Is(err, errCircuitOpen) {
+			return backend, ticket, err
+		}
+		healthy = slices.Delete(healthy, pick, pick+1)
+	}
+
+	return nil, Ticket{}, errCircuitOpen
+}
+
+// Report releases the in-flight slot and feeds the observed latency into the backend's average
+func (p2c *PowerOfTwoChoices) Report(b *Backend, outcome Outcome) {
+	p2c.pool.Report(b, outcome)
+	if outcome.Canceled() {
+		return
+	}
+
+	latency := outcome.Duration
+	if outcome.Err != nil && latency < failurePenalty {
+		latency = failurePenalty
+	}
+	p2c.latencies[b].observe(latency, p2c.decay)
+}
+
+// score estimates how long a new request would wait on b, lower is better
+func (p2c *PowerOfTwoChoices) score(b *Backend) float64 {
+	return p2c.latencies[b].value(p2c.decay) * float64(b.InFlight()+1)
+}
+
+// ewma is a time decayed moving average of latency in nanoseconds. Samples
+// that arrive close together move the average less than ones spread apart,
+// and without new samples the average fades toward zero.
+type ewma struct {
+	mu      sync.Mutex
+	average float64
+	stamp   time.Time
+}
+
+func (e *ewma) observe(latency time.Duration, decay time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if e.stamp.IsZero() {
+		e.average = float64(latency)
+		e.stamp = now
+		return
+	}
+
+	elapsed := now.Sub(e.stamp)
+	e.stamp = now
+
+	weight := math.Exp(-float64(elapsed) / float64(decay))
+	e.average = e.average*weight + float64(latency)*(1-weight)
+}
+
+// value returns the average decayed for the time since the last sample. A
+// backend that was slow once is not picked and so gets no new samples, it
+// would be starved for good if its last average stuck.
+func (e *ewma) value(decay time.Duration) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stamp.IsZero() {
+		return 0
+	}
+	return e.average * math.Exp(-float64(time.Since(e.stamp))/float64(decay))
+}
@@ -0,0 +1,193 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Backend is a single upstream server managed by a balancer
+type Backend struct {
+	URL      *url.URL
+	Weight   int
+	healthy  atomic.Bool
+	inFlight atomic.Int64
+
+	// ejectedUntil is the unix nano time until which outlier detection keeps the backend out
+	ejectedUntil atomic.Int64
+
+	// breaker is nil unless circuit breaking is enabled
+	breaker *circuitBreaker
+
+	// Consecutive active health check results, only touched by the health checker
+	passes   int
+	failures int
+}
+
+// Healthy reports whether the last health check of the backend passed
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+// Ejected reports whether outlier detection has temporarily removed the backend
+func (b *Backend) Ejected() bool {
+	return time.Now().UnixNano() < b.ejectedUntil.Load()
+}
+
+// Available reports whether the backend may receive new requests
+func (b *Backend) Available() bool {
+	if !b.Healthy() || b.Ejected() {
+		return false
+	}
+	return b.breaker == nil || b.breaker.ready()
+}
+
+// CircuitState returns the state of the backend's circuit breaker, empty when circuit breaking is disabled
+func (b *Backend) CircuitState() string {
+	if b.breaker == nil {
+		return ""
+	}
+	return b.breaker.current()
+}
+
+// InFlight returns the number of requests handed to the backend that have not been reported back yet
+func (b *Backend) InFlight() int64 {
+	return b.inFlight.Load()
+}
+
+// pool holds the backends shared by every strategy and runs the periodic health checks
+type pool struct {
+	backends []*Backend
+	config   *models.Config
+	health   *healthChecker
+	outliers *outlierDetector
+	logger   *zap.Logger
+}
+
+func newPool(config *models.Config, logger *zap.Logger) (*pool, error) {
+	backends := make([]*Backend, 0, len(config.Backends))
+
+	// Parse backend URLs
+	for _, entry := range config.Backends {
+		backendURL, err := url.Parse(entry.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend URL %s: %w", entry.URL, err)
+		}
+
+		// Entries without an explicit weight count as 1
+		weight := entry.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		backend := &Backend{URL: backendURL, Weight: weight}
+		if config.CircuitBreaker.Enabled {
+			backend.breaker = newCircuitBreaker(config.CircuitBreaker, backendURL.Host, logger)
+		}
+		backends = append(backends, backend)
+	}
+
+	if len(backends) == 0 {
+		return nil, errors.New("no backends provided")
+	}
+
+	health, err := newHealthChecker(config.HealthCheck, config.Upstream.TLS, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{
+		backends: backends,
+		config:   config,
+		health:   health,
+		logger:   logger,
+	}
+	if config.OutlierDetection.Enabled {
+		p.outliers = newOutlierDetector(config.OutlierDetection, backends, logger)
+	}
+
+	// Initial health check, a single result decides the starting state
+	for _, backend := range p.backends {
+		backend.healthy.Store(p.health.check(backend))
+	}
+
+	// Ensure at least one backend is healthy
+	logger.Info("Ensuring at least one backend is healthy")
+	healthy := false
+	for _, backend := range p.backends {
+		if backend.Healthy() {
+			healthy = true
+			break
+		}
+	}
+	if !healthy {
+		return nil, errors.New("no healthy backends available on startup")
+	}
+
+	// Start periodic health checks
+	go p.health.run(p.backends)
+
+	return p, nil
+}
+
+// members returns the backends managed by the pool
+func (p *pool) members() []*Backend {
+	return p.backends
+}
+
+// acquire marks a request as in flight on b, strategies call it on the backend
+// they pick. It fails when b's circuit breaker stopped letting requests through
+// since b was checked, for example when another request took the last probe.
+func (p *pool) acquire(b *Backend) (*Backend, Ticket, error) {
+	var ticket Ticket
+	if b.breaker != nil {
+		probe, ok := b.breaker.acquire()
+		if !ok {
+			return nil, Ticket{}, errCircuitOpen
+		}
+		ticket.probe = probe
+	}
+	b.inFlight.Add(1)
+	return b, ticket, nil
+}
+
+// Report releases the in-flight slot taken when b was picked and feeds the
+// circuit breaker and outlier detection
+func (p *pool) Report(b *Backend, outcome Outcome) {
+	b.inFlight.Add(-1)
+	if b.breaker != nil {
+		b.breaker.record(outcome, outcome.Ticket.probe)
+	}
+	if p.outliers != nil {
+		p.outliers.record(b, outcome)
+	}
+}
+
+// Release gives back the in-flight slot and any probe slot taken when b was
+// picked, leaving the circuit breaker and outlier detection untouched
+func (p *pool) Release(b *Backend, ticket Ticket) {
+	b.inFlight.Add(-1)
+	if b.breaker != nil {
+		b.breaker.release(ticket.probe)
+	}
+}
+
+// Backends returns a snapshot of every backend in the pool
+func (p *pool) Backends() []BackendStatus {
+	statuses := make([]BackendStatus, 0, len(p.backends))
+	for _, backend := range p.backends {
+		statuses = append(statuses, BackendStatus{
+			URL:          backend.URL.String(),
+			Weight:       backend.Weight,
+			Healthy:      backend.Healthy(),
+			Ejected:      backend.Ejected(),
+			CircuitState: backend.CircuitState(),
+			InFlight:     backend.InFlight(),
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"errors"
+	"http-reverse-proxy/pkg/models"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// RoundRobin hands out healthy backends in a fixed rotation
+type RoundRobin struct {
+	*pool
+	current int
+	mu      sync.Mutex
+}
+
+func NewRoundRobin(config *models.Config, logger *zap.Logger) (*RoundRobin, error) {
+	p, err := newPool(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RoundRobin{pool: p}, nil
+}
+
+// Check for next available backend end
+func (rr *RoundRobin) NextBackend(r *http.Request) (*Backend, Ticket, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	numBackends := len(rr.backends)
+	if numBackends == 0 {
+		return nil, Ticket{}, errors.New("no backends available")
+	}
+
+	// loop through all backends and find first available one in RR, exist if none is available
+	refused := false
+	for i := 0; i < numBackends; i++ {
+		backend := rr.backends[rr.current]
+		rr.current = (rr.current + 1) % numBackends
+
+		if !eligible(r, backend) {
+			continue
+		}
+		// A breaker that turns the request away only rules out this backend
+		picked, ticket, err := rr.acquire(backend)
+		if errors.Is(err, errCircuitOpen) {
+			refused = true
+			continue
+		}
+		return picked, ticket, err
+	}
+
+	return nil, Ticket{}, noBackend(refused)
+}
@@ -0,0 +1,189 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStickyCookieName is used when load_balancing.sticky.cookie_name is left empty
+const DefaultStickyCookieName = "proxy_affinity"
+
+// SessionAffinity is implemented by balancers that pin clients to a backend with a cookie
+type SessionAffinity interface {
+	// AffinityCookie returns the cookie to send back to the client after r was
+	// routed to b, or nil when the client already holds a valid cookie for b
+	AffinityCookie(r *http.Request, b *Backend) *http.Cookie
+}
+
+// pooled is satisfied by every strategy built on top of pool
+type pooled interface {
+	members() []*Backend
+	acquire(b *Backend) (*Backend, Ticket, error)
+}
+
+// StickySessions wraps another balancer and sends clients back to the backend
+// named in their affinity cookie for as long as that backend stays healthy.
+// The cookie carries an opaque backend ID and its expiry signed with
+// HMAC-SHA256 so clients cannot steer themselves onto arbitrary backends or
+// keep a cookie past its TTL. When the pinned backend is unavailable the
+// wrapped balancer picks a new one and the cookie is replaced.
+type StickySessions struct {
+	Balancer
+	pool     pooled
+	config   models.StickyConfig
+	secret   []byte
+	byID     map[string]*Backend
+	sameSite http.SameSite
+}
+
+func newStickySessions(balancer Balancer, config models.StickyConfig) (*StickySessions, error) {
+	if config.Secret == "" {
+		return nil, errors.New("load_balancing.sticky.secret is required")
+	}
+
+	p, ok := balancer.(pooled)
+	if !ok {
+		return nil, errors.New("sticky sessions are not supported by this strategy")
+	}
+
+	var sameSite http.SameSite
+	switch strings.ToLower(config.SameSite) {
+	case "", "lax":
+		sameSite = http.SameSiteLaxMode
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown load_balancing.sticky.same_site %q", config.SameSite)
+	}
+
+	if config.CookieName == "" {
+		config.CookieName = DefaultStickyCookieName
+	}
+
+	byID := make(map[string]*Backend)
+	for _, backend := range p.members() {
+		byID[backendID(backend)] = backend
+	}
+
+	return &StickySessions{
+		Balancer: balancer,
+		pool:     p,
+		config:   config,
+		secret:   []byte(config.Secret),
+		byID:     byID,
+		sameSite: sameSite,
+	}, nil
+}
+
+func (s *StickySessions) NextBackend(r *http.Request) (*Backend, Ticket, error) {
+	if backend := s.pinnedBackend(r); backend != nil && eligible(r, backend) {
+		picked, ticket, err := s.pool.acquire(backend)
+		if !errors.Is(err, errCircuitOpen) {
+			return picked, ticket, err
+		}
+		// Its breaker turned the request away, keep it out of the wrapped strategy's pick too
+		excluded, _ := r.Context().Value(excludedKey{}).([]*Backend)
+		r = r.WithContext(WithExcluded(r.Context(), append(slices.Clip(excluded), backend)...))
+	}
+
+	// No cookie, a forged one, or the pinned backend is down: fail over to the wrapped strategy
+	return s.Balancer.NextBackend(r)
+}
+
+func (s *StickySessions) AffinityCookie(r *http.Request, b *Backend) *http.Cookie {
+	// Active sessions get a fresh cookie once half of the TTL has passed
+	pinned, expires := s.pin(r)
+	if pinned == b && (expires.IsZero() || time.Until(expires) > s.config.TTL/2) {
+		return nil
+	}
+
+	// Session cookies carry no expiry, their value is signed with zero instead
+	var expiry int64
+	if s.config.TTL > 0 {
+		expires = time.Now().Add(s.config.TTL)
+		expiry = expires.UnixMilli()
+	}
+	payload := backendID(b) + "." + strconv.FormatInt(expiry, 10)
+	cookie := &http.Cookie{
+		Name:     s.config.CookieName,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.config.Secure,
+		SameSite: s.sameSite,
+	}
+	if s.config.TTL > 0 {
+		cookie.MaxAge = int(s.config.TTL / time.Second)
+		cookie.Expires = expires
+	}
+	return cookie
+}
+
+// pinnedBackend returns the backend named by a correctly signed affinity cookie, if any
+func (s *StickySessions) pinnedBackend(r *http.Request) *Backend {
+	backend, _ := s.pin(r)
+	return backend
+}
+
+// pin returns the backend named by a correctly signed, unexpired affinity
+// cookie and when the cookie expires, zero for session cookies
+func (s *StickySessions) pin(r *http.Request) (*Backend, time.Time) {
+	cookie, err := r.Cookie(s.config.CookieName)
+	if err != nil {
+		return nil, time.Time{}
+	}
+
+	payload, signature, ok := cutLast(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return nil, time.Time{}
+	}
+	id, rawExpiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return nil, time.Time{}
+	}
+	expiry, err := strconv.ParseInt(rawExpiry, 10, 64)
+	if err != nil {
+		return nil, time.Time{}
+	}
+
+	// The browser dropping the cookie is not enough, a replayed one must not pin either
+	var expires time.Time
+	if expiry != 0 {
+		if expires = time.UnixMilli(expiry); !time.Now().Before(expires) {
+			return nil, time.Time{}
+		}
+	}
+	return s.byID[id], expires
+}
+
+func (s *StickySessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// backendID is a stable identifier that does not leak the backend address to clients
+func backendID(b *Backend) string {
+	sum := sha256.Sum256([]byte(b.URL.String()))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,82 @@
+package loadbalancer
+
+import (
+	"errors"
+	"http-reverse-proxy/pkg/models"
+	"net/http"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// WeightedRoundRobin spreads requests in proportion to backend weights using
+// the smooth weighted round robin algorithm popularised by nginx. Heavier
+// backends are picked more often without being picked in long bursts.
+type WeightedRoundRobin struct {
+	*pool
+	currentWeights []int
+	mu             sync.Mutex
+}
+
+func NewWeightedRoundRobin(config *models.Config, logger *zap.Logger) (*WeightedRoundRobin, error) {
+	p, err := newPool(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WeightedRoundRobin{
+		pool:           p,
+		currentWeights: make([]int, len(p.backends)),
+	}, nil
+}
+
+// NextBackend raises every healthy backend's current weight by its configured
+// weight, picks the highest one and lowers it by the total weight
+func (wrr *WeightedRoundRobin) NextBackend(r *http.Request) (*Backend, Ticket, error) {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	var candidates []int
+	total := 0
+	for i, backend := range wrr.backends {
+		if !eligible(r, backend) {
+			continue
+		}
+
+		wrr.currentWeights[i] += backend.Weight
+		total += backend.Weight
+		candidates = append(candidates, i)
+	}
+
+	if len(candidates) == 0 {
+		return nil, Ticket{}, errors.New("no healthy backends available")
+	}
+
+	// A breaker that turns the request away only rules out its backend, the next highest is tried
+	raised := slices.Clone(candidates)
+	for len(candidates) > 0 {
+		best := 0
+		for c := range candidates {
+			if wrr.currentWeights[candidates[c]] > wrr.currentWeights[candidates[best]] {
+				best = c
+			}
+		}
+
+		picked, ticket, err := wrr.acquire(wrr.backends[candidates[best]])
+		if errors.Is(err, errCircuitOpen) {
+			candidates = slices.Delete(candidates, best, best+1)
+			continue
+		}
+		if err == nil {
+			wrr.currentWeights[candidates[best]] -= total
+		}
+		return picked, ticket, err
+	}
+
+	// Every breaker refused, take the weights back so the rotation is unchanged
+	for _, i := range raised {
+		wrr.currentWeights[i] -= wrr.backends[i].Weight
+	}
+	return nil, Ticket{}, errCircuitOpen
+}
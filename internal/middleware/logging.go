@@ -1,12 +1,29 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+type routeInfoKey struct{}
+
+// RouteInfo records how a request was routed so the access log can report it,
+// the proxy fills it in through RouteInfoFrom
+type RouteInfo struct {
+	VirtualHost string
+	Route       string
+	Upstream    string
+}
+
+// RouteInfoFrom returns the RouteInfo of the request, nil outside LoggingMiddleware
+func RouteInfoFrom(ctx context.Context) *RouteInfo {
+	info, _ := ctx.Value(routeInfoKey{}).(*RouteInfo)
+	return info
+}
+
 func LoggingMiddleware(logger *zap.Logger) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -23,15 +40,24 @@ func LoggingMiddleware(logger *zap.Logger) Middleware {
 			)
 
 			// Serve the request
-			next.ServeHTTP(wrapped, r)
+			info := &RouteInfo{}
+			next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), routeInfoKey{}, info)))
 
 			// Log the response
-			logger.Info("Completed request",
+			fields := []zap.Field{
 				zap.Int("status", wrapped.statusCode),
 				zap.String("method", r.Method),
 				zap.String("path", r.URL.Path),
 				zap.Duration("duration", time.Since(start)),
-			)
+			}
+			if info.Route != "" {
+				fields = append(fields,
+					zap.String("virtual_host", info.VirtualHost),
+					zap.String("route", info.Route),
+					zap.String("upstream", info.Upstream),
+				)
+			}
+			logger.Info("Completed request", fields...)
 		})
 	}
 }
@@ -1,6 +1,10 @@
 package middleware
 
-import "net/http"
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
 
 type Middleware func(http.Handler) http.Handler
 type wrappedResponseWriter struct {
@@ -13,6 +17,20 @@ func (w *wrappedResponseWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 }
 
+// Hijack hands the connection over to the handler, as for a WebSocket upgrade
+func (w *wrappedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush for example
+func (w *wrappedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
 	// Apply middleware in reverse order
 	// Last middleware is executed first
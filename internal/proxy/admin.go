@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// requireAdmin only lets requests carrying the configured admin token through
+func (rp *ReverseProxy) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(rp.Config.Admin.Token)) != 1 {
+			rp.Logger.Warn("Rejected admin request",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("remote_addr", r.RemoteAddr))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// splitRequest is the body accepted by SplitHandler
+type splitRequest struct {
+	Weight *float64 `json:"weight"`
+}
+
+// SplitHandler changes the canary weight of a route at runtime, it serves
+// PUT /admin/routes/{name}/split with a body such as {"weight": 5}
+func (rp *ReverseProxy) SplitHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	split, ok := rp.splits[name]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	previous := split.currentWeight()
+	if err := split.setManualWeight(*req.Weight); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rp.Logger.Info("Canary weight changed",
+		zap.String("route", name),
+		zap.Float64("previous_weight", previous),
+		zap.Float64("weight", *req.Weight),
+		zap.String("remote_addr", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(split.status()); err != nil {
+		rp.Logger.Error("Failed to encode split response", zap.Error(err))
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes the proxy answers with, see https://grpc.io/docs/guides/status-codes/
+const (
+	grpcUnknown          = 2
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// isGRPC reports whether r is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTimeoutUnits are the units of the grpc-timeout header
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout value such as "250m", at most 8 digits followed by a unit
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// encodeGRPCTimeout formats d for the grpc-timeout header in the finest unit that fits in 8 digits
+func encodeGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	const maxAmount = 1e8 - 1
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"n", time.Nanosecond},
+		{"u", time.Microsecond},
+		{"m", time.Millisecond},
+		{"S", time.Second},
+		{"M", time.Minute},
+	} {
+		// Round up, a deadline of zero would fail the call outright
+		if amount := (d + unit.size - 1) / unit.size; amount <= maxAmount {
+			return fmt.Sprintf("%d%s", amount, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dH", min((d+time.Hour-1)/time.Hour, maxAmount))
+}
+
+// grpcCode maps an HTTP status the proxy would answer with to a gRPC status
+// code, following the HTTP to gRPC mapping of the gRPC specification
+func grpcCode(status int, err error) int {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errUpstreamTimeout) {
+		return grpcDeadlineExceeded
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// writeGRPCError answers a gRPC call with a trailers-only response carrying the status
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes message as the grpc-message header requires
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// proxyError answers r with a failure of the proxy itself, as a gRPC status for gRPC calls
+func proxyError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if isGRPC(r) {
+		writeGRPCError(w, grpcCode(status, err), "proxy: "+strings.ToLower(http.StatusText(status)))
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// withGRPCDeadline bounds r by the deadline its grpc-timeout header asks for
+func withGRPCDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout"))
+	if !isGRPC(r) || !ok {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// announceTrailers declares the trailers the backend declared up front
+func announceTrailers(h http.Header, trailer http.Header) {
+	for key := range trailer {
+		h.Add("Trailer", key)
+	}
+}
+
+// copyTrailers sets the backend's trailers once the body has been copied, with
+// http.TrailerPrefix since gRPC backends send trailers they never declared
+func copyTrailers(h http.Header, trailer http.Header) {
+	for key, values := range trailer {
+		for _, value := range values {
+			h.Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
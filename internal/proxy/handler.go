@@ -1,96 +1,329 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"http-reverse-proxy/internal/loadbalancer"
+	"http-reverse-proxy/internal/middleware"
+	"http-reverse-proxy/pkg/utils"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// upstreamAttempt is a single try of a request against one backend
+type upstreamAttempt struct {
+	backend *loadbalancer.Backend
+	// balancer picked backend and is told how the attempt went, along with ticket
+	balancer loadbalancer.Balancer
+	ticket   loadbalancer.Ticket
+	target   string
+	start    time.Time
+	// latency is how long the backend took to answer with headers, or to fail
+	latency time.Duration
+	resp    *http.Response
+	err     error
+	// cancel releases the context of a hedged attempt, nil otherwise
+	cancel context.CancelFunc
+	// release ends the attempt's own request context, with the reason as its cause
+	release context.CancelCauseFunc
+	ctx     context.Context
+	// timeout cancels the attempt once the upstream timeout has passed, streams stop it
+	timeout *time.Timer
+}
+
+// errUpstreamTimeout ends attempts that took longer than the upstream timeout
+var errUpstreamTimeout = errors.New("upstream timeout exceeded")
+
+// timedOut reports whether the attempt was cut off by the upstream timeout
+func (a *upstreamAttempt) timedOut() bool {
+	return a.ctx != nil && errors.Is(context.Cause(a.ctx), errUpstreamTimeout)
+}
+
 // ProxyHandler handles all requests not matched by other routes and proxies them to backends
 func (rp *ReverseProxy) ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	backendURL, err := rp.LoadBalancer.NextBackend()
-	if err != nil {
-		rp.Logger.Error("No backend available", zap.Error(err))
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	vhost, _ := rp.vhosts.match(r)
+	route := vhost.routes.match(r)
+	pool := route.choosePool(r)
+	start := time.Now()
+	if info := middleware.RouteInfoFrom(r.Context()); info != nil {
+		info.VirtualHost = vhost.name
+		info.Route = route.name
+		info.Upstream = pool.name
+	}
+	if protocol := upgradeType(r.Header); protocol != "" {
+		rp.serveUpgrade(w, r, route, pool, protocol)
 		return
 	}
+	// gRPC calls carry their own deadline, which the backend is held to as well
+	r, cancel := withGRPCDeadline(r)
+	defer cancel()
+	balancer := pool.balancer
+	hedged := rp.hedging.applies(r.Method)
+	mirrored := route.mirror.sample()
 
-	// Ensure backend URL has scheme
-	target := backendURL.Host
-	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
-		target = "http://" + target
+	bodyLimit := rp.retries.config.MaxBodyBytes
+	if mirrored {
+		bodyLimit = route.mirror.bodyLimit(bodyLimit)
 	}
-
-	// Parse the backend URL
-	targetURL, err := url.Parse(target)
+	body, size, replayable, err := bufferBody(r, bodyLimit, rp.retries.retryable(r.Method, route) || hedged || mirrored)
 	if err != nil {
-		rp.Logger.Error("Invalid backend URL",
-			zap.String("backend", target),
-			zap.Error(err))
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		rp.Logger.Error("Failed to read request body", zap.Error(err))
+		proxyError(w, r, http.StatusBadRequest, err)
 		return
 	}
+	if mirrored {
+		rp.mirror(r, route, body, replayable)
+	}
+	// Only the mirror gets the larger buffer, retries and hedges keep to their own limit
+	replayable = replayable && size <= rp.retries.config.MaxBodyBytes
+	rp.retries.budget.recordRequest()
+	if hedged {
+		rp.hedging.budget.recordRequest()
+	}
 
-	// Construct full backend URL
-	targetURL.Path = r.URL.Path
-	targetURL.RawQuery = r.URL.RawQuery
+	// Try backends until one answers acceptably or the retry policy gives up
+	var (
+		tried []*loadbalancer.Backend
+		last  *upstreamAttempt
+	)
+	for retries := 0; ; retries++ {
+		backend, ticket, err := balancer.NextBackend(r.WithContext(loadbalancer.WithExcluded(r.Context(), tried...)))
+		if err != nil {
+			if last == nil {
+				rp.Logger.Error("No backend available", zap.String("upstream", pool.name), zap.Error(err))
+				route.observe(r, pool, http.StatusServiceUnavailable, time.Since(start))
+				proxyError(w, r, http.StatusServiceUnavailable, err)
+				return
+			}
+			// Nowhere left to retry, hand back the last result
+			break
+		}
 
-	// Create request to backend
-	proxyReq, err := http.NewRequest(r.Method, targetURL.String(), r.Body)
-	if err != nil {
-		rp.Logger.Error("Failed to create backend request", zap.Error(err))
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
-	}
+		// Only let go of the previous failure once there is something to replace it with
+		if last != nil {
+			rp.finish(last, nil)
+		}
 
-	// Copy original headers
-	copyHeaders(proxyReq.Header, r.Header)
+		tried = append(tried, backend)
+		if hedged && replayable {
+			last, tried = rp.hedgedForward(r, route, pool, backend, ticket, body, tried)
+		} else {
+			last = rp.forward(r, route, pool, backend, ticket, body())
+		}
 
-	// Add proxy headers
-	proxyReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	proxyReq.Header.Set("X-Forwarded-Host", r.Host)
-	proxyReq.Header.Set("X-Forwarded-Proto", r.URL.Scheme)
-	if r.URL.Scheme == "" {
-		proxyReq.Header.Set("X-Forwarded-Proto", "http")
-	}
+		if !rp.retries.shouldRetry(r, route, replayable, retries, last) {
+			break
+		}
+
+		rp.Logger.Warn("Retrying request on another backend",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("backend", last.target),
+			zap.Int("retry", retries+1),
+			zap.Error(last.err))
 
-	// Send request to backend
-	client := &http.Client{
-		Timeout: rp.Config.Server.ReadTimeout,
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 100,
-		},
+		if !rp.retries.backoff(r.Context(), retries) {
+			break
+		}
 	}
 
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		rp.Logger.Error("Backend request failed",
-			zap.String("backend", targetURL.String()),
-			zap.Error(err))
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	var copyErr error
+	defer func() { rp.finish(last, copyErr) }()
+
+	if last.err != nil {
+		route.observe(r, pool, http.StatusBadGateway, time.Since(start))
+		proxyError(w, r, http.StatusBadGateway, last.err)
 		return
 	}
-	defer resp.Body.Close()
+	route.observe(r, pool, last.resp.StatusCode, time.Since(start))
+	resp := last.resp
 
 	// Copy response headers
 	copyHeaders(w.Header(), resp.Header)
+	removeHopHeaders(w.Header())
+	announceTrailers(w.Header(), resp.Trailer)
+
+	// Pin the client to this backend if session affinity is enabled
+	if affinity, ok := balancer.(loadbalancer.SessionAffinity); ok {
+		if cookie := affinity.AffinityCookie(r, last.backend); cookie != nil {
+			http.SetCookie(w, cookie)
+		}
+	}
+
 	w.WriteHeader(resp.StatusCode)
 
-	// Stream response body
-	written, err := io.Copy(w, resp.Body)
+	// Stream response body, flushing as it arrives when the route or content type asks for it
+	written, err := rp.copyResponse(w, route, last)
+	if errors.Is(err, errStreamIdle) {
+		rp.Logger.Info("Closed idle stream",
+			zap.String("path", r.URL.Path),
+			zap.String("backend", last.target),
+			zap.Int64("bytes_written", written))
+		return
+	}
 	if err != nil {
 		rp.Logger.Error("Failed to copy response body", zap.Error(err))
+		copyErr = err
 		return
 	}
+	copyTrailers(w.Header(), resp.Trailer)
 
 	rp.Logger.Info("Request proxied successfully",
 		zap.String("method", r.Method),
 		zap.String("path", r.URL.Path),
-		zap.String("backend", targetURL.String()),
+		zap.String("virtual_host", vhost.name),
+		zap.String("route", route.name),
+		zap.String("backend", last.target),
 		zap.Int64("bytes_written", written),
 		zap.Int("status", resp.StatusCode),
+		zap.Int("attempts", len(tried)),
 	)
 }
+
+// forward sends r to backend with the given body and returns the attempt, the
+// response is left open for the caller
+func (rp *ReverseProxy) forward(r *http.Request, route *route, pool *upstreamPool, backend *loadbalancer.Backend, ticket loadbalancer.Ticket, body io.Reader) *upstreamAttempt {
+	a := &upstreamAttempt{backend: backend, balancer: pool.balancer, ticket: ticket, start: time.Now()}
+
+	// Keep the backend's scheme, base path and query, applying the route's rewrite rules to the request's
+	targetURL := backendTarget(backend.URL, route.rewrite.apply(r.URL))
+	a.target = targetURL.String()
+
+	// Create request to backend, tied to the client so it is cancelled if they go away
+	a.ctx, a.release = context.WithCancelCause(r.Context())
+	grpc := isGRPC(r)
+	if timeout := rp.upstreams.timeout; timeout > 0 && !grpc {
+		a.timeout = time.AfterFunc(timeout, func() { a.release(errUpstreamTimeout) })
+	}
+	proxyReq, err := http.NewRequestWithContext(a.ctx, r.Method, targetURL.String(), body)
+	if err != nil {
+		rp.Logger.Error("Failed to create backend request", zap.Error(err))
+		a.err = err
+		return a
+	}
+	if body != nil && proxyReq.ContentLength == 0 {
+		proxyReq.ContentLength = r.ContentLength
+	}
+	proxyReq.Trailer = r.Trailer
+
+	// Copy original headers, except those that only apply to the client connection
+	copyHeaders(proxyReq.Header, r.Header)
+	removeHopHeaders(proxyReq.Header)
+	if grpc {
+		// gRPC backends refuse calls that do not accept trailers, and get what is left of the deadline
+		proxyReq.Header.Set("Te", "trailers")
+		if deadline, ok := a.ctx.Deadline(); ok {
+			proxyReq.Header.Set("Grpc-Timeout", encodeGRPCTimeout(time.Until(deadline)))
+		}
+	}
+
+	// Add proxy headers
+	setForwardedHeaders(proxyReq.Header, r)
+
+	// Send request to backend over its pooled connections
+	a.resp, a.err = rp.upstreams.clientFor(backend).Do(proxyReq)
+	a.latency = time.Since(a.start)
+	if a.err != nil && a.timedOut() {
+		// Not the client's doing, unlike other cancellations
+		a.err = errUpstreamTimeout
+	}
+	if errors.Is(a.err, context.Canceled) {
+		// The client went away or this was a losing hedge, not a backend problem
+		rp.Logger.Debug("Backend request cancelled", zap.String("backend", a.target))
+		return a
+	}
+	if a.err != nil {
+		rp.Logger.Error("Backend request failed",
+			zap.String("backend", a.target),
+			zap.Error(a.err))
+		return a
+	}
+	rp.hedging.observe(route, a.latency)
+	return a
+}
+
+// setForwardedHeaders tells the backend who the original client and host were
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	h.Set("X-Forwarded-For", r.RemoteAddr)
+	h.Set("X-Forwarded-Host", r.Host)
+	h.Set("X-Forwarded-Proto", r.URL.Scheme)
+	switch {
+	case r.URL.Scheme != "":
+	case r.TLS != nil:
+		h.Set("X-Forwarded-Proto", "https")
+	default:
+		h.Set("X-Forwarded-Proto", "http")
+	}
+}
+
+// backendTarget joins the path and query of u onto the backend URL base
+func backendTarget(base *url.URL, u *url.URL) *url.URL {
+	target := &url.URL{
+		Scheme:   utils.RequestScheme(base),
+		User:     base.User,
+		Host:     base.Host,
+		RawQuery: base.RawQuery,
+	}
+
+	escaped := joinPaths(base.EscapedPath(), u.EscapedPath())
+	target.Path, _ = url.PathUnescape(escaped)
+	target.RawPath = escaped
+
+	switch {
+	case target.RawQuery == "":
+		target.RawQuery = u.RawQuery
+	case u.RawQuery != "":
+		target.RawQuery += "&" + u.RawQuery
+	}
+	return target
+}
+
+// joinPaths joins two escaped paths with exactly one slash between them
+func joinPaths(base, path string) string {
+	switch {
+	case base == "" || base == "/":
+		return path
+	case path == "" || path == "/":
+		// A request for the root maps to the base itself, with a trailing slash
+		if strings.HasSuffix(base, "/") || path == "" {
+			return base
+		}
+		return base + "/"
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// finish closes the attempt's response and reports how it went to the balancer
+func (rp *ReverseProxy) finish(a *upstreamAttempt, copyErr error) {
+	outcome := loadbalancer.Outcome{
+		Err: a.err,
+		// Not the time spent copying the body, streams and downloads would look slow
+		Duration: a.latency,
+		Ticket:   a.ticket,
+	}
+	if a.resp != nil {
+		a.resp.Body.Close()
+		outcome.StatusCode = a.resp.StatusCode
+		if outcome.Err == nil {
+			outcome.Err = copyErr
+		}
+	}
+	if outcome.Err != nil && a.timedOut() {
+		outcome.Err = errUpstreamTimeout
+	}
+	if a.timeout != nil {
+		a.timeout.Stop()
+	}
+	if a.release != nil {
+		a.release(nil)
+	}
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.balancer.Report(a.backend, outcome)
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"http-reverse-proxy/internal/loadbalancer"
+	"http-reverse-proxy/pkg/models"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHedgeBudgetRatio = 0.1
+	defaultHedgeBudgetMin   = 1
+
+	// latencySamples is how many recent latencies are kept per route for percentile based delays
+	latencySamples = 256
+	// minLatencySamples is how many samples a route needs before its percentile is trusted
+	minLatencySamples = 20
+)
+
+// hedgePolicy decides when a slow request is duplicated onto a second backend
+type hedgePolicy struct {
+	config models.HedgingConfig
+	budget *requestBudget
+
+	mu        sync.Mutex
+	latencies map[*route]*latencyWindow
+}
+
+func newHedgePolicy(config models.HedgingConfig) *hedgePolicy {
+	if config.BudgetRatio <= 0 {
+		config.BudgetRatio = defaultHedgeBudgetRatio
+	}
+	if config.BudgetMinHedges <= 0 {
+		config.BudgetMinHedges = defaultHedgeBudgetMin
+	}
+
+	return &hedgePolicy{
+		config:    config,
+		budget:    newRequestBudget(config.BudgetRatio, config.BudgetMinHedges),
+		latencies: make(map[*route]*latencyWindow),
+	}
+}
+
+// applies reports whether requests with this method may be hedged at all
+func (hp *hedgePolicy) applies(method string) bool {
+	return hp.config.Enabled && isIdempotent(method)
+}
+
+// delay returns how long to wait for the first backend before hedging, zero disables hedging.
+// With a percentile configured the route's recent latency is used once enough samples exist.
+func (hp *hedgePolicy) delay(route *route) time.Duration {
+	if hp.config.Percentile > 0 {
+		hp.mu.Lock()
+		window := hp.latencies[route]
+		hp.mu.Unlock()
+
+		if window != nil {
+			if p, ok := window.percentile(hp.config.Percentile); ok {
+				return p
+			}
+		}
+	}
+	return hp.config.Delay
+}
+
+// observe records how long a backend took to return response headers on route
+func (hp *hedgePolicy) observe(route *route, latency time.Duration) {
+	if !hp.config.Enabled || hp.config.Percentile <= 0 {
+		return
+	}
+
+	hp.mu.Lock()
+	window, ok := hp.latencies[route]
+	if !ok {
+		window = &latencyWindow{}
+		hp.latencies[route] = window
+	}
+	hp.mu.Unlock()
+
+	window.add(latency)
+}
+
+// latencyWindow keeps the most recent latency samples in a ring buffer
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	next    int
+	count   int
+}
+
+func (lw *latencyWindow) add(latency time.Duration) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.samples[lw.next] = latency
+	lw.next = (lw.next + 1) % latencySamples
+	lw.count = min(lw.count+1, latencySamples)
+}
+
+func (lw *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	lw.mu.Lock()
+	sorted := slices.Clone(lw.samples[:lw.count])
+	lw.mu.Unlock()
+
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	slices.Sort(sorted)
+
+	index := int(float64(len(sorted)-1) * min(p, 100) / 100)
+	return sorted[index], true
+}
+
+// hedgedForward sends r to primary and, if it has not answered within the
+// hedge delay, to a second backend as well. The first response without a
+// transport error wins and the other request is cancelled. It returns the
+// winning attempt along with tried extended by any hedge backend.
+func (rp *ReverseProxy) hedgedForward(r *http.Request, route *route, pool *upstreamPool, primary *loadbalancer.Backend, ticket loadbalancer.Ticket, body func() io.Reader, tried []*loadbalancer.Backend) (*upstreamAttempt, []*loadbalancer.Backend) {
+	delay := rp.hedging.delay(route)
+	if delay <= 0 {
+		return rp.forward(r, route, pool, primary, ticket, body()), tried
+	}
+
+	results := make(chan *upstreamAttempt, 2)
+	launch := func(backend *loadbalancer.Backend, ticket loadbalancer.Ticket) context.CancelFunc {
+		ctx, cancel := context.WithCancel(r.Context())
+		go func() {
+			a := rp.forward(r.WithContext(ctx), route, pool, backend, ticket, body())
+			a.cancel = cancel
+			results <- a
+		}()
+		return cancel
+	}
+	cancels := map[*loadbalancer.Backend]context.CancelFunc{primary: launch(primary, ticket)}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case a := <-results:
+		return a, tried
+	case <-timer.C:
+	}
+
+	// The primary is slow, try to bring in a second backend. The budget is only
+	// spent once there is one, no other backend means no hedge.
+	hedge, hedgeTicket, err := pool.balancer.NextBackend(r.WithContext(loadbalancer.WithExcluded(r.Context(), tried...)))
+	if err != nil {
+		return <-results, tried
+	}
+	if !rp.hedging.budget.tryAcquire() {
+		// Never sent, so there is nothing to judge the backend on
+		pool.balancer.Release(hedge, hedgeTicket)
+		rp.Logger.Debug("Hedge budget exhausted, waiting on primary", zap.String("path", r.URL.Path))
+		return <-results, tried
+	}
+	tried = append(tried, hedge)
+	rp.Logger.Info("Hedging slow request",
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("primary", primary.URL.Host),
+		zap.String("hedge", hedge.URL.Host),
+		zap.Duration("delay", delay))
+	cancels[hedge] = launch(hedge, hedgeTicket)
+
+	first := <-results
+	if first.err != nil {
+		// A transport error does not win the race, give the other request its chance
+		second := <-results
+		rp.finish(first, nil)
+		return second, tried
+	}
+
+	// Cancel the loser right away and report it once it has unwound
+	for backend, cancel := range cancels {
+		if backend != first.backend {
+			cancel()
+		}
+	}
+	go func() {
+		rp.finish(<-results, nil)
+	}()
+	return first, tried
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMirrorMaxBodyBytes = 64 << 10
+	defaultMirrorHeader       = "X-Shadow-Request"
+	defaultMirrorTimeout      = 10 * time.Second
+	defaultMirrorMaxInFlight  = 100
+)
+
+// mirrorSide collects the results of either the primary or the shadow requests of a mirrored route
+type mirrorSide struct {
+	mu        sync.Mutex
+	requests  int
+	errors    int
+	statuses  map[int]int
+	latencies latencyWindow
+}
+
+// observe records a response status, or err when no response arrived, and the time to response headers
+func (ms *mirrorSide) observe(status int, err error, latency time.Duration) {
+	ms.mu.Lock()
+	ms.requests++
+	if err != nil {
+		ms.errors++
+	} else {
+		if ms.statuses == nil {
+			ms.statuses = make(map[int]int)
+		}
+		ms.statuses[status]++
+	}
+	ms.mu.Unlock()
+
+	if err == nil {
+		ms.latencies.add(latency)
+	}
+}
+
+// MirrorSideStatus summarizes the primary or the shadow side of a mirrored route
+type MirrorSideStatus struct {
+	Requests int `json:"requests"`
+	// Errors counts requests that got no response at all
+	Errors   int         `json:"errors"`
+	Statuses map[int]int `json:"statuses,omitempty"`
+	// P50 and P99 are in milliseconds, zero until enough requests have been seen
+	P50 float64 `json:"p50_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+func (ms *mirrorSide) snapshot() MirrorSideStatus {
+	ms.mu.Lock()
+	status := MirrorSideStatus{Requests: ms.requests, Errors: ms.errors}
+	for code, count := range ms.statuses {
+		if status.Statuses == nil {
+			status.Statuses = make(map[int]int)
+		}
+		status.Statuses[code] = count
+	}
+	ms.mu.Unlock()
+
+	if p50, ok := ms.latencies.percentile(50); ok {
+		status.P50 = float64(p50) / float64(time.Millisecond)
+	}
+	if p99, ok := ms.latencies.percentile(99); ok {
+		status.P99 = float64(p99) / float64(time.Millisecond)
+	}
+	return status
+}
+
+// trafficMirror copies a sample of a route's requests to a shadow pool and
+// keeps the results of both sides apart so they can be compared
+type trafficMirror struct {
+	route  string
+	pool   *upstreamPool
+	config models.MirrorConfig
+
+	// inFlight holds a token per running shadow request
+	inFlight chan struct{}
+
+	primary mirrorSide
+	shadow  mirrorSide
+	// dropped counts copies not sent because too many were in flight,
+	// skipped those whose body was too large to buffer
+	dropped atomic.Int64
+	skipped atomic.Int64
+}
+
+func newTrafficMirror(route string, pools map[string]*upstreamPool, config models.MirrorConfig) (*trafficMirror, error) {
+	pool, ok := pools[config.Upstream]
+	if !ok {
+		return nil, fmt.Errorf("unknown mirror upstream %q", config.Upstream)
+	}
+	if config.Percentage < 0 || config.Percentage > 100 {
+		return nil, fmt.Errorf("mirror percentage must be between 0 and 100, got %v", config.Percentage)
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+	if config.Header == "" {
+		config.Header = defaultMirrorHeader
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultMirrorTimeout
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = defaultMirrorMaxInFlight
+	}
+
+	return &trafficMirror{
+		route:    route,
+		pool:     pool,
+		config:   config,
+		inFlight: make(chan struct{}, config.MaxInFlight),
+	}, nil
+}
+
+// sample reports whether the current request should be copied, it is false on a nil mirror
+func (tm *trafficMirror) sample() bool {
+	if tm == nil || tm.config.Percentage <= 0 {
+		return false
+	}
+	return tm.config.Percentage >= 100 || rand.Float64()*100 < tm.config.Percentage
+}
+
+// bodyLimit returns how much of the body to buffer, the larger of limit and what the mirror needs
+func (tm *trafficMirror) bodyLimit(limit int64) int64 {
+	return max(limit, tm.config.MaxBodyBytes)
+}
+
+// copyBody returns the body to send to the shadow pool, false when it cannot be
+// replayed or is larger than max_body_bytes. Chunked bodies have no length up
+// front, so the limit is checked on the bytes actually read.
+func (tm *trafficMirror) copyBody(body func() io.Reader, replayable bool, contentLength int64) ([]byte, bool) {
+	if !replayable || contentLength > tm.config.MaxBodyBytes {
+		return nil, false
+	}
+	reader := body()
+	if reader == nil {
+		return nil, true
+	}
+	payload, err := io.ReadAll(io.LimitReader(reader, tm.config.MaxBodyBytes+1))
+	if err != nil || int64(len(payload)) > tm.config.MaxBodyBytes {
+		return nil, false
+	}
+	return payload, true
+}
+
+// mirror sends a copy of r to the route's shadow pool in the background. The
+// copy is built before returning, so r may be released as soon as the client
+// is answered, and nothing about the shadow request reaches the client.
+func (rp *ReverseProxy) mirror(r *http.Request, route *route, body func() io.Reader, replayable bool) {
+	tm := route.mirror
+	payload, ok := tm.copyBody(body, replayable, r.ContentLength)
+	if !ok {
+		tm.skipped.Add(1)
+		rp.Logger.Debug("Request body too large to mirror", zap.String("route", route.name))
+		return
+	}
+
+	select {
+	case tm.inFlight <- struct{}{}:
+	default:
+		tm.dropped.Add(1)
+		rp.Logger.Debug("Too many shadow requests in flight, dropping copy", zap.String("route", route.name))
+		return
+	}
+
+	backend, ticket, err := tm.pool.balancer.NextBackend(r)
+	if err != nil {
+		<-tm.inFlight
+		tm.shadow.observe(0, err, 0)
+		rp.Logger.Debug("No shadow backend available", zap.String("upstream", tm.pool.name), zap.Error(err))
+		return
+	}
+
+	// Detached from the client, the copy runs on its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), tm.config.Timeout)
+	target := backendTarget(backend.URL, route.rewrite.apply(r.URL))
+	shadowReq, err := http.NewRequestWithContext(ctx, r.Method, target.String(), bytes.NewReader(payload))
+	if err != nil {
+		cancel()
+		<-tm.inFlight
+		tm.pool.balancer.Release(backend, ticket)
+		tm.shadow.observe(0, err, 0)
+		rp.Logger.Error("Failed to create shadow request", zap.Error(err))
+		return
+	}
+	copyHeaders(shadowReq.Header, r.Header)
+	removeHopHeaders(shadowReq.Header)
+	setForwardedHeaders(shadowReq.Header, r)
+	shadowReq.Header.Set(tm.config.Header, "true")
+
+	go func() {
+		defer func() { <-tm.inFlight }()
+		defer cancel()
+
+		start := time.Now()
+		resp, err := rp.upstreams.clientFor(backend).Do(shadowReq)
+		latency := time.Since(start)
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// Shadow traffic must not trip breakers or eject backends the pool may serve live traffic from
+		tm.pool.balancer.Release(backend, ticket)
+		tm.shadow.observe(status, err, latency)
+
+		rp.Logger.Debug("Shadow request completed",
+			zap.String("route", route.name),
+			zap.String("backend", target.String()),
+			zap.Int("status", status),
+			zap.Duration("latency", latency),
+			zap.Error(err))
+	}()
+}
+
+// MirrorStatus compares the primary and shadow sides of a mirrored route
+type MirrorStatus struct {
+	Route      string           `json:"route"`
+	Upstream   string           `json:"upstream"`
+	Percentage float64          `json:"percentage"`
+	Dropped    int64            `json:"dropped"`
+	Skipped    int64            `json:"skipped"`
+	Primary    MirrorSideStatus `json:"primary"`
+	Shadow     MirrorSideStatus `json:"shadow"`
+}
+
+func (tm *trafficMirror) status() MirrorStatus {
+	return MirrorStatus{
+		Route:      tm.route,
+		Upstream:   tm.pool.name,
+		Percentage: tm.config.Percentage,
+		Dropped:    tm.dropped.Load(),
+		Skipped:    tm.skipped.Load(),
+		Primary:    tm.primary.snapshot(),
+		Shadow:     tm.shadow.snapshot(),
+	}
+}
@@ -2,8 +2,11 @@ package proxy
 
 import (
 	"encoding/json"
+	"fmt"
 	"http-reverse-proxy/pkg/models"
 	"net/http"
+	"slices"
+	"strings"
 
 	"http-reverse-proxy/internal/loadbalancer"
 
@@ -11,35 +14,130 @@ import (
 )
 
 type ReverseProxy struct {
-	LoadBalancer *loadbalancer.RoundRobin
+	LoadBalancer loadbalancer.Balancer
 	Logger       *zap.Logger
 	Config       *models.Config
+	retries      *retryPolicy
+	hedging      *hedgePolicy
+	upstreams    *upstreamClients
+	pools        map[string]*upstreamPool
+	vhosts       *virtualHosts
+	// splits holds the routes with a traffic split by name, for runtime weight changes
+	splits map[string]*trafficSplit
+	// mirrors holds every route that copies traffic to a shadow pool
+	mirrors []*trafficMirror
+	// tunnels holds the open WebSocket and other upgraded connections
+	tunnels tunnels
+	// streams holds the responses being streamed to clients
+	streams streams
 }
 
 // NewReverseProxy initializes a new ReverseProxy instance
-func NewReverseProxy(lb *loadbalancer.RoundRobin, logger *zap.Logger, config *models.Config) (*ReverseProxy, error) {
+func NewReverseProxy(lb loadbalancer.Balancer, logger *zap.Logger, config *models.Config) (*ReverseProxy, error) {
+	pools, err := newUpstreamPools(lb, config, logger)
+	if err != nil {
+		return nil, err
+	}
+	vhosts, err := newVirtualHosts(config, pools)
+	if err != nil {
+		return nil, err
+	}
+	splits := make(map[string]*trafficSplit)
+	var mirrors []*trafficMirror
+	for _, vhost := range vhosts.all {
+		for _, rt := range vhost.routes.routes() {
+			if rt.mirror != nil {
+				mirrors = append(mirrors, rt.mirror)
+			}
+			if rt.split == nil {
+				continue
+			}
+			if _, ok := splits[rt.name]; ok {
+				return nil, fmt.Errorf("route %s: routes with a split need a unique name", rt.name)
+			}
+			splits[rt.name] = rt.split
+		}
+	}
+	for _, split := range splits {
+		if !split.config.Rollout.Enabled {
+			continue
+		}
+		if split.rollout, err = newRollout(split, split.config.Rollout, logger); err != nil {
+			return nil, fmt.Errorf("route %s: %w", split.route, err)
+		}
+		go split.rollout.run()
+	}
+	upstreams, err := newUpstreamClients(config.Upstream, config.Server.ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ReverseProxy{
 		LoadBalancer: lb,
 		Logger:       logger,
 		Config:       config,
+		retries:      newRetryPolicy(config.Retry, logger),
+		hedging:      newHedgePolicy(config.Hedging),
+		upstreams:    upstreams,
+		pools:        pools,
+		vhosts:       vhosts,
+		splits:       splits,
+		mirrors:      mirrors,
 	}, nil
 }
 
+// Close stops running rollouts and releases idle pooled connections to the backends
+func (rp *ReverseProxy) Close() {
+	for _, split := range rp.splits {
+		if split.rollout != nil {
+			split.rollout.stop("proxy shutting down")
+		}
+	}
+	rp.upstreams.closeIdle()
+}
+
 // StatusResponse defines the structure of the status response
 type StatusResponse struct {
-	Status  string `json:"status"`
-	Uptime  string `json:"uptime"`
-	Version string `json:"version"`
+	Status   string                       `json:"status"`
+	Uptime   string                       `json:"uptime"`
+	Version  string                       `json:"version"`
+	Backends []loadbalancer.BackendStatus `json:"backends"`
+	// Upstreams lists the backends of every named pool besides the default one
+	Upstreams map[string][]loadbalancer.BackendStatus `json:"upstreams,omitempty"`
+	Splits    []SplitStatus                           `json:"splits,omitempty"`
+	Mirrors   []MirrorStatus                          `json:"mirrors,omitempty"`
 }
 
 // StatusHandler provides the current status and uptime of the proxy
 func (rp *ReverseProxy) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Example static response; in a real-world scenario, dynamically calculate uptime and version
 	response := StatusResponse{
-		Status:  "running",
-		Uptime:  "72h",   // This should be dynamically calculated
-		Version: "1.0.0", // Ideally fetched from build variables
+		Status:   "running",
+		Uptime:   "72h",   // This should be dynamically calculated
+		Version:  "1.0.0", // Ideally fetched from build variables
+		Backends: rp.LoadBalancer.Backends(),
+	}
+	for name, pool := range rp.pools {
+		if name == models.DefaultUpstream {
+			continue
+		}
+		if response.Upstreams == nil {
+			response.Upstreams = make(map[string][]loadbalancer.BackendStatus)
+		}
+		response.Upstreams[name] = pool.balancer.Backends()
+	}
+	for _, split := range rp.splits {
+		response.Splits = append(response.Splits, split.status())
+	}
+	slices.SortFunc(response.Splits, func(a, b SplitStatus) int {
+		return strings.Compare(a.Route, b.Route)
+	})
+	for _, mirror := range rp.mirrors {
+		response.Mirrors = append(response.Mirrors, mirror.status())
 	}
+	slices.SortFunc(response.Mirrors, func(a, b MirrorStatus) int {
+		return strings.Compare(a.Route, b.Route)
+	})
 
 	// Encode response as JSON
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"http-reverse-proxy/pkg/models"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetryMaxBodyBytes = 64 << 10
+	defaultRetryBackoffBase  = 25 * time.Millisecond
+	defaultRetryBackoffMax   = 250 * time.Millisecond
+	defaultRetryBudgetRatio  = 0.2
+	defaultRetryBudgetMin    = 3
+
+	// budgetWindow is how long request counts are kept before a budget starts over
+	budgetWindow = 10 * time.Second
+)
+
+// retryPolicy decides whether a failed attempt is sent again to another backend
+type retryPolicy struct {
+	config models.RetryConfig
+	budget *requestBudget
+	logger *zap.Logger
+}
+
+func newRetryPolicy(config models.RetryConfig, logger *zap.Logger) *retryPolicy {
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = defaultRetryMaxBodyBytes
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = defaultRetryBackoffBase
+	}
+	if config.BackoffMax <= 0 {
+		config.BackoffMax = defaultRetryBackoffMax
+	}
+	if config.BudgetRatio <= 0 {
+		config.BudgetRatio = defaultRetryBudgetRatio
+	}
+	if config.BudgetMinRetries <= 0 {
+		config.BudgetMinRetries = defaultRetryBudgetMin
+	}
+
+	return &retryPolicy{
+		config: config,
+		budget: newRequestBudget(config.BudgetRatio, config.BudgetMinRetries),
+		logger: logger,
+	}
+}
+
+// isIdempotent reports whether method can safely be sent more than once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a request with this method may be retried at all on route
+func (rp *retryPolicy) retryable(method string, route *route) bool {
+	return rp.config.Attempts > 0 && (isIdempotent(method) || rp.config.NonIdempotent || route.retryNonIdempotent)
+}
+
+// bufferBody reads the request body into memory so it can be replayed by
+// retries or hedges. Bodies larger than limit, or requests that will never be
+// replayed, are streamed instead and replayable is false. size is the number of
+// bytes kept in memory.
+func bufferBody(r *http.Request, limit int64, wanted bool) (body func() io.Reader, size int64, replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() io.Reader { return nil }, 0, true, nil
+	}
+
+	// Do not pay for buffering when the request could never be replayed
+	if !wanted || r.ContentLength > limit {
+		return func() io.Reader { return r.Body }, 0, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	// Too large to keep, stitch what was read back in front of the rest of the stream
+	if int64(len(buf)) > limit {
+		stream := io.MultiReader(bytes.NewReader(buf), r.Body)
+		return func() io.Reader { return stream }, 0, false, nil
+	}
+
+	return func() io.Reader { return bytes.NewReader(buf) }, int64(len(buf)), true, nil
+}
+
+// shouldRetry is called after an attempt failed or returned a response, retries is the number already made
+func (rp *retryPolicy) shouldRetry(r *http.Request, route *route, replayable bool, retries int, a *upstreamAttempt) bool {
+	if !replayable || !rp.retryable(r.Method, route) || retries >= rp.config.Attempts {
+		return false
+	}
+
+	// The client has gone away, there is nobody to retry for
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	if a.err == nil && !slices.Contains(rp.config.RetryOn, a.resp.StatusCode) {
+		return false
+	}
+
+	if !rp.budget.tryAcquire() {
+		rp.logger.Warn("Retry budget exhausted, not retrying",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("backend", a.target))
+		return false
+	}
+	return true
+}
+
+// backoff sleeps for an exponentially growing, fully jittered delay. It returns
+// false if the request context is cancelled first.
+func (rp *retryPolicy) backoff(ctx context.Context, retries int) bool {
+	delay := rp.config.BackoffBase << retries
+	if delay <= 0 || delay > rp.config.BackoffMax {
+		delay = rp.config.BackoffMax
+	}
+	delay = time.Duration(rand.Int64N(int64(delay) + 1))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// requestBudget caps extra upstream requests, such as retries or hedges, to a
+// share of recent client requests so they cannot multiply load on a pool that
+// is already struggling
+type requestBudget struct {
+	ratio   float64
+	minimum int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	spent       int
+}
+
+func newRequestBudget(ratio float64, minimum int) *requestBudget {
+	return &requestBudget{
+		ratio:       ratio,
+		minimum:     minimum,
+		windowStart: time.Now(),
+	}
+}
+
+func (b *requestBudget) recordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// tryAcquire spends one extra request from the budget, returning false when it is exhausted
+func (b *requestBudget) tryAcquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+
+	allowed := max(int(float64(b.requests)*b.ratio), b.minimum)
+	if b.spent >= allowed {
+		return false
+	}
+	b.spent++
+	return true
+}
+
+// roll must be called with mu held
+func (b *requestBudget) roll() {
+	if now := time.Now(); now.Sub(b.windowStart) >= budgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.spent = 0
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// rewriter changes the path and query of a request before it is sent to the
+// backend. Paths are rewritten in their escaped form so that encoded
+// characters such as %2F reach the backend as the client sent them.
+type rewriter struct {
+	// from and to replace a leading path prefix, to is empty when stripping
+	from string
+	to   string
+
+	regex       *regexp.Regexp
+	replacement string
+
+	setQuery []models.QueryParam
+	addQuery []models.QueryParam
+}
+
+// newRewriter returns nil when config asks for no rewriting
+func newRewriter(config models.RewriteConfig) (*rewriter, error) {
+	if reflect.ValueOf(config).IsZero() {
+		return nil, nil
+	}
+
+	rw := &rewriter{
+		setQuery: config.SetQuery,
+		addQuery: config.AddQuery,
+	}
+	switch {
+	case config.StripPrefix != "":
+		rw.from = escapePath(config.StripPrefix)
+	case config.ReplacePrefix.From != "":
+		rw.from = escapePath(config.ReplacePrefix.From)
+		rw.to = escapePath(config.ReplacePrefix.To)
+	case config.Regex.Pattern != "":
+		re, err := regexp.Compile(config.Regex.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex: %w", err)
+		}
+		rw.regex = re
+		rw.replacement = config.Regex.Replacement
+	}
+	return rw, nil
+}
+
+// escapePath returns the escaped form of a path written in config
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// apply returns the path and query to request from the backend for u
+func (rw *rewriter) apply(u *url.URL) *url.URL {
+	if rw == nil {
+		return &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	}
+
+	escaped := u.EscapedPath()
+	switch {
+	case rw.from != "":
+		escaped = replacePrefix(escaped, rw.from, rw.to)
+	case rw.regex != nil:
+		escaped = rw.regex.ReplaceAllString(escaped, rw.replacement)
+	}
+	if !strings.HasPrefix(escaped, "/") {
+		escaped = "/" + escaped
+	}
+
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		// A replacement produced a broken escape, send it as a plain path instead
+		path, escaped = escaped, ""
+	}
+	// RawPath is only needed when the default encoding of path differs
+	if escaped == escapePath(path) {
+		escaped = ""
+	}
+
+	rawQuery := u.RawQuery
+	if len(rw.setQuery) > 0 || len(rw.addQuery) > 0 {
+		query := u.Query()
+		for _, param := range rw.setQuery {
+			query.Set(param.Name, param.Value)
+		}
+		for _, param := range rw.addQuery {
+			query.Add(param.Name, param.Value)
+		}
+		rawQuery = query.Encode()
+	}
+
+	return &url.URL{Path: path, RawPath: escaped, RawQuery: rawQuery}
+}
+
+// replacePrefix swaps a leading from for to in path, matching whole segments only
+func replacePrefix(path, from, to string) string {
+	from = strings.TrimSuffix(from, "/")
+	rest, ok := strings.CutPrefix(path, from)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return path
+	}
+	to = strings.TrimSuffix(to, "/")
+	if rest == "" {
+		return cmp.Or(to, "/")
+	}
+	return to + rest
+}
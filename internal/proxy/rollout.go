@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Rollout states reported in RolloutStatus
+const (
+	RolloutProgressing = "progressing"
+	RolloutCompleted   = "completed"
+	RolloutRolledBack  = "rolled_back"
+	RolloutStopped     = "stopped"
+)
+
+const (
+	defaultRolloutInterval             = 5 * time.Minute
+	defaultRolloutCheckInterval        = 10 * time.Second
+	defaultRolloutMinimumRequests      = 20
+	defaultRolloutMaxErrorRateIncrease = 0.05
+	defaultRolloutMaxLatencyRatio      = 1.5
+
+	// rolloutLatencySlack keeps jitter on very fast pools from tripping the latency ratio
+	rolloutLatencySlack = 5 * time.Millisecond
+)
+
+// rolloutSide collects the results of one side of a split during the current step
+type rolloutSide struct {
+	mu        sync.Mutex
+	requests  int
+	errors    int
+	latencies *latencyWindow
+}
+
+func (rs *rolloutSide) observe(status int, latency time.Duration) {
+	rs.mu.Lock()
+	rs.requests++
+	if status >= 500 {
+		rs.errors++
+	}
+	window := rs.latencies
+	rs.mu.Unlock()
+
+	window.add(latency)
+}
+
+func (rs *rolloutSide) reset() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.requests = 0
+	rs.errors = 0
+	rs.latencies = &latencyWindow{}
+}
+
+// RolloutSideStatus summarizes one side of a split during the current rollout step
+type RolloutSideStatus struct {
+	Requests  int     `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	// P99 is in milliseconds, zero until enough requests have been seen
+	P99 float64 `json:"p99_ms"`
+}
+
+func (rs *rolloutSide) snapshot() RolloutSideStatus {
+	rs.mu.Lock()
+	status := RolloutSideStatus{Requests: rs.requests}
+	if rs.requests > 0 {
+		status.ErrorRate = float64(rs.errors) / float64(rs.requests)
+	}
+	window := rs.latencies
+	rs.mu.Unlock()
+
+	if p99, ok := window.percentile(99); ok {
+		status.P99 = float64(p99) / float64(time.Millisecond)
+	}
+	return status
+}
+
+// rollout steps the weight of a traffic split up on a schedule and rolls it
+// back to 0 as soon as the canary does noticeably worse than the stable pool
+type rollout struct {
+	split  *trafficSplit
+	config models.RolloutConfig
+	logger *zap.Logger
+
+	stable rolloutSide
+	canary rolloutSide
+
+	mu          sync.Mutex
+	state       string
+	step        int
+	stepStarted time.Time
+	reason      string
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRollout(split *trafficSplit, config models.RolloutConfig, logger *zap.Logger) (*rollout, error) {
+	if len(config.Steps) == 0 {
+		return nil, errors.New("rollout needs at least one step")
+	}
+	for _, step := range config.Steps {
+		if step < 0 || step > 100 {
+			return nil, fmt.Errorf("rollout steps must be between 0 and 100, got %v", step)
+		}
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultRolloutInterval
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaultRolloutCheckInterval
+	}
+	if config.MinimumRequests <= 0 {
+		config.MinimumRequests = defaultRolloutMinimumRequests
+	}
+	if config.MaxErrorRateIncrease <= 0 {
+		config.MaxErrorRateIncrease = defaultRolloutMaxErrorRateIncrease
+	}
+	if config.MaxLatencyRatio <= 0 {
+		config.MaxLatencyRatio = defaultRolloutMaxLatencyRatio
+	}
+
+	ro := &rollout{
+		split:  split,
+		config: config,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	split.setWeight(config.Steps[0])
+	ro.state = RolloutProgressing
+	ro.stepStarted = time.Now()
+	ro.stable.reset()
+	ro.canary.reset()
+	return ro, nil
+}
+
+// run evaluates the rollout every check interval until it completes, rolls back or is stopped
+func (ro *rollout) run() {
+	ro.logger.Info("Canary rollout started",
+		zap.String("route", ro.split.route),
+		zap.Float64("weight", ro.config.Steps[0]),
+		zap.Float64s("steps", ro.config.Steps))
+
+	ticker := time.NewTicker(ro.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ro.done:
+			return
+		case now := <-ticker.C:
+			if !ro.evaluate(now) {
+				return
+			}
+		}
+	}
+}
+
+// observe records the result of a request served by pool on this rollout's route
+func (ro *rollout) observe(pool *upstreamPool, status int, latency time.Duration) {
+	switch pool {
+	case ro.split.canary:
+		ro.canary.observe(status, latency)
+	case ro.split.stable:
+		ro.stable.observe(status, latency)
+	}
+}
+
+// evaluate compares the two pools and moves the rollout along, it returns false once the rollout is over
+func (ro *rollout) evaluate(now time.Time) bool {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if ro.state != RolloutProgressing {
+		return false
+	}
+
+	stable, canary := ro.stable.snapshot(), ro.canary.snapshot()
+	if canary.Requests >= ro.config.MinimumRequests {
+		// With the stable pool (nearly) drained, hold the canary to a clean baseline instead
+		baseline := stable
+		if stable.Requests < ro.config.MinimumRequests {
+			baseline = RolloutSideStatus{}
+		}
+		if reason := ro.breach(baseline, canary); reason != "" {
+			ro.split.setWeight(0)
+			ro.state = RolloutRolledBack
+			ro.reason = reason
+			ro.logger.Warn("Canary rollout rolled back",
+				zap.String("route", ro.split.route),
+				zap.String("reason", reason),
+				zap.Float64("canary_error_rate", canary.ErrorRate),
+				zap.Float64("stable_error_rate", stable.ErrorRate),
+				zap.Float64("canary_p99_ms", canary.P99),
+				zap.Float64("stable_p99_ms", stable.P99))
+			return false
+		}
+	}
+
+	// Hold the step until it has lasted long enough and the canary has seen enough traffic to judge it
+	if now.Sub(ro.stepStarted) < ro.config.Interval || canary.Requests < ro.config.MinimumRequests {
+		return true
+	}
+
+	if ro.step == len(ro.config.Steps)-1 {
+		ro.state = RolloutCompleted
+		ro.logger.Info("Canary rollout completed",
+			zap.String("route", ro.split.route),
+			zap.Float64("weight", ro.split.currentWeight()))
+		return false
+	}
+
+	ro.step++
+	weight := ro.config.Steps[ro.step]
+	ro.split.setWeight(weight)
+	ro.stepStarted = now
+	ro.stable.reset()
+	ro.canary.reset()
+	ro.logger.Info("Canary rollout advanced",
+		zap.String("route", ro.split.route),
+		zap.Int("step", ro.step),
+		zap.Float64("weight", weight),
+		zap.Float64("canary_error_rate", canary.ErrorRate),
+		zap.Float64("stable_error_rate", stable.ErrorRate))
+	return true
+}
+
+// breach returns why the canary is doing worse than the stable pool, empty if it is not
+func (ro *rollout) breach(stable, canary RolloutSideStatus) string {
+	if canary.ErrorRate-stable.ErrorRate > ro.config.MaxErrorRateIncrease {
+		return fmt.Sprintf("canary error rate %.3f exceeds stable %.3f", canary.ErrorRate, stable.ErrorRate)
+	}
+	slack := float64(rolloutLatencySlack) / float64(time.Millisecond)
+	if stable.P99 > 0 && canary.P99 > stable.P99*ro.config.MaxLatencyRatio && canary.P99 > stable.P99+slack {
+		return fmt.Sprintf("canary p99 %.1fms exceeds stable %.1fms", canary.P99, stable.P99)
+	}
+	return ""
+}
+
+// stop ends a rollout that is still progressing, for example when the weight is changed by hand
+func (ro *rollout) stop(reason string) {
+	ro.mu.Lock()
+	if ro.state == RolloutProgressing {
+		ro.state = RolloutStopped
+		ro.reason = reason
+		ro.logger.Info("Canary rollout stopped",
+			zap.String("route", ro.split.route),
+			zap.String("reason", reason))
+	}
+	ro.mu.Unlock()
+
+	ro.stopOnce.Do(func() { close(ro.done) })
+}
+
+// RolloutStatus reports the progress of an automated canary rollout
+type RolloutStatus struct {
+	State  string            `json:"state"`
+	Step   int               `json:"step"`
+	Steps  []float64         `json:"steps"`
+	Reason string            `json:"reason,omitempty"`
+	Stable RolloutSideStatus `json:"stable"`
+	Canary RolloutSideStatus `json:"canary"`
+}
+
+func (ro *rollout) status() *RolloutStatus {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	return &RolloutStatus{
+		State:  ro.state,
+		Step:   ro.step,
+		Steps:  ro.config.Steps,
+		Reason: ro.reason,
+		Stable: ro.stable.snapshot(),
+		Canary: ro.canary.snapshot(),
+	}
+}
@@ -1,17 +1,352 @@
 package proxy
 
 import (
+	"cmp"
+	"fmt"
+	"http-reverse-proxy/internal/loadbalancer"
+	"http-reverse-proxy/pkg/models"
 	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
 )
 
-// SetupRoutes registers all necessary routes and returns the mux
-func (rp *ReverseProxy) SetupRoutes() *http.ServeMux {
+// SetupRoutes registers all necessary routes and returns a handler that serves
+// them behind the CORS and rate limiting middleware of each virtual host
+func (rp *ReverseProxy) SetupRoutes() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/status", rp.StatusHandler)
 
-	// Proxy all other routes
+	// Runtime changes are only possible once an admin token is configured
+	if rp.Config.Admin.Token != "" {
+		mux.HandleFunc("PUT /admin/routes/{name}/split", rp.requireAdmin(rp.SplitHandler))
+	}
+
+	// Proxy all other routes, ProxyHandler picks the upstream pool from the route table
 	mux.Handle("/", http.HandlerFunc(rp.ProxyHandler))
 
-	return mux
+	rp.buildHandlers(mux)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vhost, ok := rp.vhosts.match(r)
+		if !ok {
+			rp.Logger.Warn("Host header does not match TLS server name",
+				zap.String("host", r.Host),
+				zap.String("server_name", r.TLS.ServerName),
+				zap.String("remote_addr", r.RemoteAddr))
+			proxyError(w, r, http.StatusMisdirectedRequest, nil)
+			return
+		}
+		vhost.handler.ServeHTTP(w, r)
+	})
+}
+
+// upstreamPool is a named group of backends behind its own balancer
+type upstreamPool struct {
+	name     string
+	balancer loadbalancer.Balancer
+}
+
+// newUpstreamPools builds a balancer for every named pool in config, next to
+// the default pool made of the top-level backends
+func newUpstreamPools(defaultBalancer loadbalancer.Balancer, config *models.Config, logger *zap.Logger) (map[string]*upstreamPool, error) {
+	pools := map[string]*upstreamPool{
+		models.DefaultUpstream: {name: models.DefaultUpstream, balancer: defaultBalancer},
+	}
+	for name, pool := range config.Upstreams {
+		balancer, err := loadbalancer.New(poolConfig(config, name, pool), logger.With(zap.String("upstream", name)))
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		pools[name] = &upstreamPool{name: name, balancer: balancer}
+	}
+	return pools, nil
+}
+
+// poolConfig derives the config a named pool's balancer is built from, sections
+// the pool leaves empty are inherited from the top level
+func poolConfig(config *models.Config, name string, pool models.PoolConfig) *models.Config {
+	derived := *config
+	derived.Backends = pool.Backends
+	if !reflect.ValueOf(pool.LoadBalancing).IsZero() {
+		derived.LoadBalancing = pool.LoadBalancing
+	}
+	// Every affinity cookie is sent for the whole site, pools sharing a name would
+	// keep replacing each other's pins, so the pool name is added unless it has its own
+	if sticky := &derived.LoadBalancing.Sticky; sticky.Enabled && sticky.CookieName == config.LoadBalancing.Sticky.CookieName {
+		if sticky.CookieName == "" {
+			sticky.CookieName = loadbalancer.DefaultStickyCookieName
+		}
+		sticky.CookieName += "_" + name
+	}
+	if !reflect.ValueOf(pool.HealthCheck).IsZero() {
+		derived.HealthCheck = pool.HealthCheck
+	}
+	return &derived
+}
+
+// route sends the requests it matches to an upstream pool
+type route struct {
+	name   string
+	path   string
+	prefix string
+	regex  *regexp.Regexp
+	pool   *upstreamPool
+	// methods, headers and query must all match on top of the path, empty means any
+	methods []string
+	headers []condition
+	query   []condition
+	// retryNonIdempotent lets retries replay methods such as POST on this route
+	retryNonIdempotent bool
+	// rewrite is nil unless the route changes the path or query sent upstream
+	rewrite *rewriter
+	// split is nil unless part of the traffic goes to a canary pool
+	split *trafficSplit
+	// mirror is nil unless a sample of the traffic is copied to a shadow pool
+	mirror *trafficMirror
+	// streaming is nil unless the route configures how responses are streamed
+	streaming *streaming
+}
+
+// matchesPath reports whether the request path falls under the route. Prefixes
+// match whole segments unless they end in a slash.
+func (rt *route) matchesPath(path string) bool {
+	switch {
+	case rt.path != "":
+		return path == rt.path
+	case rt.prefix != "":
+		if !strings.HasPrefix(path, rt.prefix) {
+			return false
+		}
+		return len(path) == len(rt.prefix) || strings.HasSuffix(rt.prefix, "/") || path[len(rt.prefix)] == '/'
+	case rt.regex != nil:
+		return rt.regex.MatchString(path)
+	}
+	return false
+}
+
+// matches reports whether r satisfies every condition of the route, query is
+// the parsed query string of r
+func (rt *route) matches(r *http.Request, query url.Values) bool {
+	if !rt.matchesPath(r.URL.Path) {
+		return false
+	}
+	if len(rt.methods) > 0 && !slices.Contains(rt.methods, r.Method) {
+		return false
+	}
+	for _, c := range rt.headers {
+		if !c.matches(r.Header.Values(c.name)) {
+			return false
+		}
+	}
+	for _, c := range rt.query {
+		if !c.matches(query[c.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// conditions counts the non-path conditions of the route, used to try more specific routes first
+func (rt *route) conditions() int {
+	return len(rt.headers) + len(rt.query) + min(len(rt.methods), 1)
+}
+
+// condition tests the values of a header or query parameter
+type condition struct {
+	name   string
+	exact  string
+	prefix string
+	regex  *regexp.Regexp
+	absent bool
+}
+
+func newCondition(config models.MatchCondition) (condition, error) {
+	c := condition{
+		name:   config.Name,
+		exact:  config.Exact,
+		prefix: config.Prefix,
+		absent: config.Absent,
+	}
+	if config.Regex != "" {
+		re, err := regexp.Compile(config.Regex)
+		if err != nil {
+			return c, fmt.Errorf("condition %s: invalid regex: %w", config.Name, err)
+		}
+		c.regex = re
+	}
+	return c, nil
+}
+
+func newConditions(configs []models.MatchCondition) ([]condition, error) {
+	conditions := make([]condition, 0, len(configs))
+	for _, config := range configs {
+		c, err := newCondition(config)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// matches reports whether any of values satisfies the condition, or none is
+// there for absent conditions
+func (c condition) matches(values []string) bool {
+	if c.absent {
+		return len(values) == 0
+	}
+	for _, value := range values {
+		switch {
+		case c.exact != "":
+			if value == c.exact {
+				return true
+			}
+		case c.prefix != "":
+			if strings.HasPrefix(value, c.prefix) {
+				return true
+			}
+		case c.regex != nil:
+			if c.regex.MatchString(value) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// routeTable picks the route for each request. Exact paths win over prefixes,
+// the longest matching prefix wins over shorter ones, and regexes are tried
+// last in config order. Among routes with the same path those with more
+// conditions are tried first. Requests matching nothing go to the fallback route.
+type routeTable struct {
+	exact    []*route
+	prefixes []*route
+	regexes  []*route
+	fallback *route
+}
+
+func newRouteTable(configs []models.RouteConfig, pools map[string]*upstreamPool) (*routeTable, error) {
+	table := &routeTable{
+		fallback: &route{name: models.DefaultUpstream, pool: pools[models.DefaultUpstream]},
+	}
+
+	for i, config := range configs {
+		upstream := cmp.Or(config.Upstream, models.DefaultUpstream)
+		pool, ok := pools[upstream]
+		if !ok {
+			return nil, fmt.Errorf("route %d: unknown upstream %q", i, upstream)
+		}
+
+		rt := &route{
+			name:               cmp.Or(config.Name, fmt.Sprintf("route-%d", i)),
+			path:               config.Path,
+			prefix:             config.Prefix,
+			pool:               pool,
+			retryNonIdempotent: config.RetryNonIdempotent,
+		}
+		for _, method := range config.Methods {
+			rt.methods = append(rt.methods, strings.ToUpper(method))
+		}
+		var err error
+		if rt.headers, err = newConditions(config.Headers); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.name, err)
+		}
+		if rt.query, err = newConditions(config.Query); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.name, err)
+		}
+		if rt.rewrite, err = newRewriter(config.Rewrite); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.name, err)
+		}
+		if config.Split.Canary != "" {
+			if rt.split, err = newTrafficSplit(rt.name, pool, pools, config.Split); err != nil {
+				return nil, fmt.Errorf("route %s: %w", rt.name, err)
+			}
+		}
+		if config.Streaming != (models.StreamingConfig{}) {
+			rt.streaming = newStreaming(config.Streaming)
+		}
+		if config.Mirror.Upstream != "" {
+			if rt.mirror, err = newTrafficMirror(rt.name, pools, config.Mirror); err != nil {
+				return nil, fmt.Errorf("route %s: %w", rt.name, err)
+			}
+		}
+
+		switch {
+		case config.Path != "":
+			table.exact = append(table.exact, rt)
+		case config.Regex != "":
+			re, err := regexp.Compile(config.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: invalid regex: %w", rt.name, err)
+			}
+			rt.regex = re
+			table.regexes = append(table.regexes, rt)
+		default:
+			// Routes without a path matcher apply to every path
+			rt.prefix = cmp.Or(rt.prefix, "/")
+			table.prefixes = append(table.prefixes, rt)
+		}
+	}
+
+	// Longest prefix first, so the first prefix that matches is the most specific one
+	slices.SortStableFunc(table.prefixes, func(a, b *route) int {
+		return cmp.Or(len(b.prefix)-len(a.prefix), b.conditions()-a.conditions())
+	})
+	slices.SortStableFunc(table.exact, func(a, b *route) int {
+		return b.conditions() - a.conditions()
+	})
+
+	return table, nil
+}
+
+// routes returns every configured route of the table
+func (table *routeTable) routes() []*route {
+	return slices.Concat(table.exact, table.prefixes, table.regexes)
+}
+
+// choosePool returns the upstream pool that serves r on this route, applying any traffic split
+func (rt *route) choosePool(r *http.Request) *upstreamPool {
+	if rt.split != nil {
+		return rt.split.choose(r)
+	}
+	return rt.pool
+}
+
+// observe records the result of r, sent to pool, for the route's canary rollout and mirror
+func (rt *route) observe(r *http.Request, pool *upstreamPool, status int, latency time.Duration) {
+	// A client that went away says nothing about either pool
+	if r.Context().Err() != nil {
+		return
+	}
+	if rt.split != nil {
+		rt.split.observe(pool, status, latency)
+	}
+	if rt.mirror != nil {
+		rt.mirror.primary.observe(status, nil, latency)
+	}
+}
+
+// match returns the route serving r
+func (table *routeTable) match(r *http.Request) *route {
+	var query url.Values
+	if r.URL.RawQuery != "" {
+		query = r.URL.Query()
+	}
+	for _, group := range [][]*route{table.exact, table.prefixes, table.regexes} {
+		for _, rt := range group {
+			if rt.matches(r, query) {
+				return rt
+			}
+		}
+	}
+	return table.fallback
 }
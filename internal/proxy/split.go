@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"http-reverse-proxy/pkg/models"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// splitBuckets is the resolution of sticky splits, weights are honoured to a hundredth of a percent
+const splitBuckets = 10000
+
+// trafficSplit sends a share of a route's requests to a canary pool. It runs
+// before the balancing step, so the chosen pool's balancer then picks the backend.
+type trafficSplit struct {
+	route  string
+	stable *upstreamPool
+	canary *upstreamPool
+	config models.SplitConfig
+
+	// weight holds the float64 bits of the canary percentage so it can change while serving
+	weight atomic.Uint64
+	// rollout is nil unless the proxy steps the weight up on its own
+	rollout *rollout
+}
+
+func newTrafficSplit(route string, stable *upstreamPool, pools map[string]*upstreamPool, config models.SplitConfig) (*trafficSplit, error) {
+	canary, ok := pools[config.Canary]
+	if !ok {
+		return nil, fmt.Errorf("unknown canary upstream %q", config.Canary)
+	}
+
+	ts := &trafficSplit{route: route, stable: stable, canary: canary, config: config}
+	if err := ts.setWeight(config.Weight); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// currentWeight returns the current percentage of requests sent to the canary
+func (ts *trafficSplit) currentWeight() float64 {
+	return math.Float64frombits(ts.weight.Load())
+}
+
+func (ts *trafficSplit) setWeight(weight float64) error {
+	if math.IsNaN(weight) || weight < 0 || weight > 100 {
+		return fmt.Errorf("split weight must be between 0 and 100, got %v", weight)
+	}
+	ts.weight.Store(math.Float64bits(weight))
+	return nil
+}
+
+// setManualWeight changes the weight from outside the rollout, which stops the rollout
+func (ts *trafficSplit) setManualWeight(weight float64) error {
+	if err := ts.setWeight(weight); err != nil {
+		return err
+	}
+	if ts.rollout != nil {
+		ts.rollout.stop("weight changed manually")
+	}
+	return nil
+}
+
+// observe records the result of a request the split sent to pool
+func (ts *trafficSplit) observe(pool *upstreamPool, status int, latency time.Duration) {
+	if ts.rollout != nil {
+		ts.rollout.observe(pool, status, latency)
+	}
+}
+
+// choose picks the pool that serves r
+func (ts *trafficSplit) choose(r *http.Request) *upstreamPool {
+	if pool := ts.override(r); pool != nil {
+		return pool
+	}
+
+	weight := ts.currentWeight()
+	switch weight {
+	case 0:
+		return ts.stable
+	case 100:
+		return ts.canary
+	}
+
+	var bucket float64
+	if ts.config.Sticky {
+		h := fnv.New64a()
+		h.Write([]byte(ts.clientKey(r)))
+		bucket = float64(h.Sum64() % splitBuckets)
+	} else {
+		bucket = float64(rand.IntN(splitBuckets))
+	}
+	if bucket < weight*splitBuckets/100 {
+		return ts.canary
+	}
+	return ts.stable
+}
+
+// override returns the pool forced by the request's override header or cookie, nil if none
+func (ts *trafficSplit) override(r *http.Request) *upstreamPool {
+	var value string
+	if ts.config.OverrideHeader != "" {
+		value = r.Header.Get(ts.config.OverrideHeader)
+	}
+	if value == "" && ts.config.OverrideCookie != "" {
+		if cookie, err := r.Cookie(ts.config.OverrideCookie); err == nil {
+			value = cookie.Value
+		}
+	}
+
+	switch strings.ToLower(value) {
+	case "canary", "true", "1":
+		return ts.canary
+	case "stable", "false", "0":
+		return ts.stable
+	}
+	return nil
+}
+
+// clientKey identifies the client for sticky splits
+func (ts *trafficSplit) clientKey(r *http.Request) string {
+	if ts.config.StickyHeader != "" {
+		if value := r.Header.Get(ts.config.StickyHeader); value != "" {
+			return value
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SplitStatus reports the traffic split of a route
+type SplitStatus struct {
+	Route  string  `json:"route"`
+	Stable string  `json:"stable"`
+	Canary string  `json:"canary"`
+	Weight float64 `json:"weight"`
+	// Rollout is set when the weight is driven by an automated rollout
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+}
+
+func (ts *trafficSplit) status() SplitStatus {
+	status := SplitStatus{
+		Route:  ts.route,
+		Stable: ts.stable.name,
+		Canary: ts.canary.name,
+		Weight: ts.currentWeight(),
+	}
+	if ts.rollout != nil {
+		status.Rollout = ts.rollout.status()
+	}
+	return status
+}
+
+// SetCanaryWeight changes the share of traffic the named route sends to its canary pool,
+// it is safe to call while requests are being served
+func (rp *ReverseProxy) SetCanaryWeight(route string, weight float64) error {
+	split, ok := rp.splits[route]
+	if !ok {
+		return fmt.Errorf("route %q has no traffic split", route)
+	}
+	return split.setManualWeight(weight)
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultStreamIdleTimeout = 5 * time.Minute
+
+// errStreamIdle ends a streamed response that carried no data for the idle timeout
+var errStreamIdle = errors.New("stream idle timeout")
+
+// errShuttingDown ends the streamed responses still open when the server shuts
+// down, it counts as cancelled since it says nothing about the backend
+var errShuttingDown = fmt.Errorf("server shutting down: %w", context.Canceled)
+
+// streaming is how a route passes responses on as they arrive, a nil
+// streaming only streams event streams, with the default idle timeout
+type streaming struct {
+	flushInterval time.Duration
+	idleTimeout   time.Duration
+}
+
+func newStreaming(config models.StreamingConfig) *streaming {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultStreamIdleTimeout
+	}
+	return &streaming{flushInterval: config.FlushInterval, idleTimeout: config.IdleTimeout}
+}
+
+// flushIntervalFor returns how often resp is flushed to the client, negative
+// after every write and zero when it is not streamed at all
+func (s *streaming) flushIntervalFor(resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || strings.HasPrefix(mediaType, "application/grpc") {
+		return -1
+	}
+	if s == nil {
+		return 0
+	}
+	return s.flushInterval
+}
+
+func (s *streaming) idle() time.Duration {
+	if s == nil {
+		return defaultStreamIdleTimeout
+	}
+	return s.idleTimeout
+}
+
+// flushWriter flushes what is written to it after every write, or at most
+// one interval after a write when the interval is positive
+type flushWriter struct {
+	w        io.Writer
+	rc       *http.ResponseController
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending *time.Timer
+	err     error
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.err != nil {
+		return 0, fw.err
+	}
+
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.interval < 0 {
+		return n, fw.rc.Flush()
+	}
+	if fw.pending == nil {
+		fw.pending = time.AfterFunc(fw.interval, fw.delayedFlush)
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.pending == nil {
+		return
+	}
+	fw.pending = nil
+	if err := fw.rc.Flush(); err != nil {
+		fw.err = err
+	}
+}
+
+// stop flushes whatever is still pending and stops the flush timer
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.pending != nil {
+		fw.pending.Stop()
+		fw.pending = nil
+	}
+	fw.rc.Flush()
+}
+
+// streams tracks the responses being streamed. They are let off the server
+// write timeout, so a graceful shutdown would otherwise wait on them until it
+// gives up.
+type streams struct {
+	mu      sync.Mutex
+	active  map[*upstreamAttempt]struct{}
+	closing bool
+}
+
+// add registers a stream, ending it right away once shutdown has begun
+func (ss *streams) add(a *upstreamAttempt) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closing {
+		a.release(errShuttingDown)
+		return
+	}
+	if ss.active == nil {
+		ss.active = make(map[*upstreamAttempt]struct{})
+	}
+	ss.active[a] = struct{}{}
+}
+
+func (ss *streams) remove(a *upstreamAttempt) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.active, a)
+}
+
+// closeAll ends every open stream and those started later, returning how many were open
+func (ss *streams) closeAll() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.closing = true
+	for a := range ss.active {
+		a.release(errShuttingDown)
+	}
+	return len(ss.active)
+}
+
+// CloseStreams ends every streamed response, and any started from now on, so
+// they do not hold up a graceful shutdown. It is meant for
+// http.Server.RegisterOnShutdown.
+func (rp *ReverseProxy) CloseStreams() {
+	if open := rp.streams.closeAll(); open > 0 {
+		rp.Logger.Info("Closing streamed responses for shutdown", zap.Int("streams", open))
+	}
+}
+
+// copyResponse copies the body of the attempt's response to the client. Bodies
+// the route streams are flushed as they arrive and, since a stream may last
+// for hours, are let off the server write timeout and the upstream timeout in
+// favour of an idle timeout on either side.
+func (rp *ReverseProxy) copyResponse(w http.ResponseWriter, route *route, a *upstreamAttempt) (int64, error) {
+	interval := route.streaming.flushIntervalFor(a.resp)
+	// A gRPC status in the headers makes a trailers-only response, usually an
+	// error, which has to reach the client without flushing the headers early
+	if interval == 0 || a.resp.Header.Get("Grpc-Status") != "" {
+		return io.Copy(w, a.resp.Body)
+	}
+
+	rc := http.NewResponseController(w)
+	idle := route.streaming.idle()
+	if a.timeout != nil {
+		a.timeout.Stop()
+	}
+	rp.streams.add(a)
+	defer rp.streams.remove(a)
+	// A backend that goes quiet ends the stream, as does a client that stops reading
+	idleTimer := time.AfterFunc(idle, func() { a.release(errStreamIdle) })
+	defer idleTimer.Stop()
+
+	fw := &flushWriter{w: w, rc: rc, interval: interval}
+	defer fw.stop()
+
+	// Send the headers right away, the first event may be a long time coming
+	rc.SetWriteDeadline(time.Now().Add(idle))
+	if err := rc.Flush(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		n, err := a.resp.Body.Read(buf)
+		if n > 0 {
+			idleTimer.Reset(idle)
+			rc.SetWriteDeadline(time.Now().Add(idle))
+			if _, werr := fw.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			if cause := context.Cause(a.ctx); errors.Is(cause, errStreamIdle) || errors.Is(cause, errShuttingDown) {
+				return written, cause
+			}
+			return written, err
+		}
+	}
+}
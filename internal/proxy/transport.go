@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"http-reverse-proxy/internal/loadbalancer"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/pkg/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDialTimeout         = 5 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultTunnelIdleTimeout   = 5 * time.Minute
+)
+
+// upstreamClients hands out one long-lived client per backend so connections
+// are pooled and reused across requests instead of being dialled every time
+type upstreamClients struct {
+	config    models.UpstreamConfig
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	clients   sync.Map // *loadbalancer.Backend -> *http.Client
+}
+
+func newUpstreamClients(config models.UpstreamConfig, timeout time.Duration) (*upstreamClients, error) {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaultKeepAlive
+	}
+	if config.TLSHandshakeTimeout <= 0 {
+		config.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	if config.IdleConnTimeout <= 0 {
+		config.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = defaultMaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost <= 0 {
+		config.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if config.TunnelIdleTimeout <= 0 {
+		config.TunnelIdleTimeout = defaultTunnelIdleTimeout
+	}
+
+	tlsConfig, err := utils.UpstreamTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamClients{config: config, timeout: timeout, tlsConfig: tlsConfig}, nil
+}
+
+// clientFor returns the client dedicated to backend, creating it on first use
+func (uc *upstreamClients) clientFor(backend *loadbalancer.Backend) *http.Client {
+	if client, ok := uc.clients.Load(backend); ok {
+		return client.(*http.Client)
+	}
+
+	// The request timeout is enforced per attempt, so streamed responses can be let off it
+	client, _ := uc.clients.LoadOrStore(backend, &http.Client{
+		Transport: uc.newTransport(backend),
+	})
+	return client.(*http.Client)
+}
+
+func (uc *upstreamClients) newTransport(backend *loadbalancer.Backend) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   uc.config.DialTimeout,
+		KeepAlive: uc.config.KeepAlive,
+	}
+
+	// h2c backends, such as gRPC servers without TLS, only speak HTTP/2
+	if backend.URL.Scheme == utils.SchemeH2C {
+		transport := utils.H2CTransport(dialer)
+		transport.IdleConnTimeout = uc.config.IdleConnTimeout
+		return transport
+	}
+
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       uc.tlsConfig.Clone(),
+		TLSHandshakeTimeout:   uc.config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: uc.config.ResponseHeaderTimeout,
+		IdleConnTimeout:       uc.config.IdleConnTimeout,
+		MaxIdleConns:          uc.config.MaxIdleConns,
+		MaxIdleConnsPerHost:   uc.config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       uc.config.MaxConnsPerHost,
+		ForceAttemptHTTP2:     uc.config.HTTP2,
+	}
+}
+
+// dial opens a raw connection to the backend at target for an upgraded
+// connection, with a TLS handshake limited to HTTP/1.1 for https backends
+func (uc *upstreamClients) dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   uc.config.DialTimeout,
+		KeepAlive: uc.config.KeepAlive,
+	}
+
+	host := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(target.Hostname(), port)
+	}
+	if target.Scheme != "https" {
+		return dialer.DialContext(ctx, "tcp", host)
+	}
+
+	tlsConfig := uc.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = target.Hostname()
+	}
+	// Upgrades only exist in HTTP/1.1
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
+	ctx, cancel := context.WithTimeout(ctx, uc.config.DialTimeout+uc.config.TLSHandshakeTimeout)
+	defer cancel()
+	return (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", host)
+}
+
+// closeIdle drops idle pooled connections to every backend
+func (uc *upstreamClients) closeIdle() {
+	uc.clients.Range(func(_, client any) bool {
+		client.(*http.Client).CloseIdleConnections()
+		return true
+	})
+}
@@ -0,0 +1,370 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"http-reverse-proxy/internal/loadbalancer"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errTunnelIdle ends a tunnel that carried no data for the idle timeout
+var errTunnelIdle = errors.New("tunnel idle timeout")
+
+// hopHeaders only apply to a single connection and are not forwarded, see RFC 9110 section 7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including those named in Connection
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol r asks to switch to, such as websocket, or "" if none
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// tunnel is an upgraded connection piped between a client and a backend
+type tunnel struct {
+	client  net.Conn
+	backend net.Conn
+	idle    time.Duration
+
+	// lastActivity is the time of the last byte through the tunnel, in unix nanoseconds
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+}
+
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// close tears both connections down, unblocking both directions
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.client.Close()
+		t.backend.Close()
+	})
+}
+
+// pipe copies src into dst until src is done. A direction that is only quiet
+// while the other one is busy is not idle, so a read deadline is re-armed from
+// the last activity of the whole tunnel before giving up.
+func (t *tunnel) pipe(dst net.Conn, src io.Reader, srcConn net.Conn) (int64, error) {
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		last := time.Unix(0, t.lastActivity.Load())
+		if time.Since(last) >= t.idle {
+			return written, errTunnelIdle
+		}
+		srcConn.SetReadDeadline(last.Add(t.idle))
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			dst.SetWriteDeadline(time.Now().Add(t.idle))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				return written, nil
+			}
+			return written, err
+		}
+	}
+}
+
+// closeWrite signals the end of one direction while leaving the other open
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// tunnels tracks the open tunnels so shutdown can wait for them to drain
+type tunnels struct {
+	mu     sync.Mutex
+	active map[*tunnel]struct{}
+	wg     sync.WaitGroup
+}
+
+func (ts *tunnels) add(t *tunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.active == nil {
+		ts.active = make(map[*tunnel]struct{})
+	}
+	ts.active[t] = struct{}{}
+	ts.wg.Add(1)
+}
+
+func (ts *tunnels) remove(t *tunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.active, t)
+	ts.wg.Done()
+}
+
+// count returns the number of open tunnels
+func (ts *tunnels) count() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.active)
+}
+
+// drain waits for the open tunnels to end and closes those still open when ctx is done
+func (ts *tunnels) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		ts.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	ts.mu.Lock()
+	open := len(ts.active)
+	for t := range ts.active {
+		t.close()
+	}
+	ts.mu.Unlock()
+	<-done
+	return fmt.Errorf("closed %d tunnels still open at shutdown: %w", open, ctx.Err())
+}
+
+// serveUpgrade proxies a request asking to switch protocols, such as a
+// WebSocket handshake. Once the backend agrees the client connection is
+// hijacked and bytes are piped both ways until either side is done. The
+// backend stays acquired from its balancer for as long as the tunnel is open,
+// but is judged on the handshake alone.
+func (rp *ReverseProxy) serveUpgrade(w http.ResponseWriter, r *http.Request, route *route, pool *upstreamPool, protocol string) {
+	start := time.Now()
+	backend, ticket, err := pool.balancer.NextBackend(r)
+	if err != nil {
+		rp.Logger.Error("No backend available", zap.String("upstream", pool.name), zap.Error(err))
+		route.observe(r, pool, http.StatusServiceUnavailable, time.Since(start))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	outcome := loadbalancer.Outcome{Ticket: ticket}
+	defer func() {
+		// Failures are timed when they happen, before any tunnel was opened
+		if outcome.Duration == 0 {
+			outcome.Duration = time.Since(start)
+		}
+		pool.balancer.Report(backend, outcome)
+	}()
+
+	target := backendTarget(backend.URL, route.rewrite.apply(r.URL))
+	backendConn, err := rp.upstreams.dial(r.Context(), target)
+	if err != nil {
+		rp.Logger.Error("Backend request failed", zap.String("backend", target.String()), zap.Error(err))
+		outcome.Err = err
+		route.observe(r, pool, http.StatusBadGateway, time.Since(start))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	tunnelled := false
+	defer func() {
+		if !tunnelled {
+			backendConn.Close()
+		}
+	}()
+
+	// Send the handshake with hop-by-hop headers replaced by the upgrade itself
+	outReq := &http.Request{
+		Method:        r.Method,
+		URL:           target,
+		Host:          target.Host,
+		Header:        make(http.Header),
+		Body:          r.Body,
+		ContentLength: r.ContentLength,
+	}
+	copyHeaders(outReq.Header, r.Header)
+	removeHopHeaders(outReq.Header)
+	setForwardedHeaders(outReq.Header, r)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", protocol)
+
+	fail := func(err error) {
+		rp.Logger.Error("Backend upgrade failed", zap.String("backend", target.String()), zap.Error(err))
+		outcome.Err = err
+		route.observe(r, pool, http.StatusBadGateway, time.Since(start))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+
+	// The handshake gets as long as a quiet tunnel would
+	backendConn.SetDeadline(time.Now().Add(rp.upstreams.config.TunnelIdleTimeout))
+	if err := outReq.Write(backendConn); err != nil {
+		fail(err)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, outReq)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer resp.Body.Close()
+	// The latency is that of the handshake, a tunnel open for an hour is not an hour long response
+	outcome.Duration = time.Since(start)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The backend turned the upgrade down, relay its answer as is
+		outcome.StatusCode = resp.StatusCode
+		route.observe(r, pool, resp.StatusCode, outcome.Duration)
+		copyHeaders(w.Header(), resp.Header)
+		removeHopHeaders(w.Header())
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	if !strings.EqualFold(upgradeType(resp.Header), protocol) {
+		fail(fmt.Errorf("backend switched to %q instead of %q", resp.Header.Get("Upgrade"), protocol))
+		return
+	}
+
+	outcome.StatusCode = resp.StatusCode
+	route.observe(r, pool, resp.StatusCode, outcome.Duration)
+	tunnelled = rp.openTunnel(w, r, resp, backendConn, backendReader, target.String(), protocol)
+}
+
+// openTunnel answers the client with the backend's 101 response and pipes the
+// two connections together until both directions are done, it reports whether
+// the backend connection was taken over
+func (rp *ReverseProxy) openTunnel(w http.ResponseWriter, r *http.Request, resp *http.Response, backendConn net.Conn, backendReader *bufio.Reader, target, protocol string) bool {
+	clientConn, clientRW, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		rp.Logger.Error("Failed to take over client connection", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+
+	t := &tunnel{client: clientConn, backend: backendConn, idle: rp.upstreams.config.TunnelIdleTimeout}
+	t.touch()
+	rp.tunnels.add(t)
+	defer rp.tunnels.remove(t)
+	defer t.close()
+
+	// Clear the deadlines of the handshake, the pipes set their own
+	clientConn.SetDeadline(time.Time{})
+	backendConn.SetDeadline(time.Time{})
+
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", protocol)
+	clientConn.SetWriteDeadline(time.Now().Add(t.idle))
+	fmt.Fprintf(clientRW, "HTTP/1.1 %s\r\n", resp.Status)
+	header.Write(clientRW)
+	clientRW.WriteString("\r\n")
+	if err := clientRW.Flush(); err != nil {
+		rp.Logger.Error("Failed to send upgrade response", zap.Error(err))
+		return true
+	}
+
+	rp.Logger.Info("Tunnel opened",
+		zap.String("protocol", protocol),
+		zap.String("path", r.URL.Path),
+		zap.String("backend", target),
+		zap.String("remote_addr", r.RemoteAddr))
+
+	// Bytes already buffered on either side are read through the buffered readers first
+	var (
+		wg               sync.WaitGroup
+		sent, received   int64
+		sendErr, recvErr error
+		start            = time.Now()
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, sendErr = t.pipe(backendConn, clientRW.Reader, clientConn)
+		if sendErr == nil {
+			closeWrite(backendConn)
+		} else {
+			t.close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		received, recvErr = t.pipe(clientConn, backendReader, backendConn)
+		if recvErr == nil {
+			closeWrite(clientConn)
+		} else {
+			t.close()
+		}
+	}()
+	wg.Wait()
+
+	rp.Logger.Info("Tunnel closed",
+		zap.String("protocol", protocol),
+		zap.String("path", r.URL.Path),
+		zap.String("backend", target),
+		zap.Int64("bytes_sent", sent),
+		zap.Int64("bytes_received", received),
+		zap.Duration("duration", time.Since(start)),
+		zap.NamedError("client_error", sendErr),
+		zap.NamedError("backend_error", recvErr))
+	return true
+}
+
+// Shutdown waits for open tunnels to finish, closing whatever is left once ctx
+// is done. http.Server.Shutdown does not wait for hijacked connections, so it
+// is called after it.
+func (rp *ReverseProxy) Shutdown(ctx context.Context) error {
+	if open := rp.tunnels.count(); open > 0 {
+		rp.Logger.Info("Waiting for tunnels to close", zap.Int("tunnels", open))
+	}
+	return rp.tunnels.drain(ctx)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"http-reverse-proxy/internal/middleware"
+	"http-reverse-proxy/pkg/models"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// defaultVirtualHost names the virtual host serving requests for unknown hosts
+const defaultVirtualHost = "default"
+
+// virtualHost serves a set of host names with its own routes and middleware settings
+type virtualHost struct {
+	name      string
+	routes    *routeTable
+	cors      models.CORSConfig
+	rateLimit models.RateLimitConfig
+	// handler is the middleware chain of the virtual host, built by SetupRoutes
+	handler http.Handler
+}
+
+// wildcardHost matches every subdomain of suffix, which includes the leading dot
+type wildcardHost struct {
+	suffix string
+	vhost  *virtualHost
+}
+
+// virtualHosts picks the virtual host for each request. Exact host names win
+// over wildcards and longer wildcards win over shorter ones. Requests for
+// unknown hosts go to the fallback built from the top-level config.
+type virtualHosts struct {
+	exact     map[string]*virtualHost
+	wildcards []wildcardHost
+	fallback  *virtualHost
+	all       []*virtualHost
+}
+
+func newVirtualHosts(config *models.Config, pools map[string]*upstreamPool) (*virtualHosts, error) {
+	routes, err := newRouteTable(config.Routes, pools)
+	if err != nil {
+		return nil, err
+	}
+	fallback := &virtualHost{
+		name:      defaultVirtualHost,
+		routes:    routes,
+		cors:      config.CORS,
+		rateLimit: config.RateLimit,
+	}
+	hosts := &virtualHosts{
+		exact:    make(map[string]*virtualHost),
+		fallback: fallback,
+		all:      []*virtualHost{fallback},
+	}
+
+	for i, vc := range config.VirtualHosts {
+		name := cmp.Or(vc.Name, fmt.Sprintf("vhost-%d", i))
+		routes, err := newRouteTable(vc.Routes, pools)
+		if err != nil {
+			return nil, fmt.Errorf("virtual host %s: %w", name, err)
+		}
+
+		vhost := &virtualHost{
+			name:      name,
+			routes:    routes,
+			cors:      config.CORS,
+			rateLimit: config.RateLimit,
+		}
+		if !reflect.ValueOf(vc.CORS).IsZero() {
+			vhost.cors = vc.CORS
+		}
+		if !reflect.ValueOf(vc.RateLimit).IsZero() {
+			vhost.rateLimit = vc.RateLimit
+		}
+		hosts.all = append(hosts.all, vhost)
+
+		for _, host := range vc.Hosts {
+			host = strings.ToLower(host)
+			if suffix, ok := strings.CutPrefix(host, "*"); ok {
+				hosts.wildcards = append(hosts.wildcards, wildcardHost{suffix: suffix, vhost: vhost})
+				continue
+			}
+			hosts.exact[host] = vhost
+		}
+	}
+
+	// Longest suffix first, so the first wildcard that matches is the most specific one
+	slices.SortStableFunc(hosts.wildcards, func(a, b wildcardHost) int {
+		return len(b.suffix) - len(a.suffix)
+	})
+
+	return hosts, nil
+}
+
+// lookup returns the virtual host serving host, which must already be normalized
+func (vh *virtualHosts) lookup(host string) *virtualHost {
+	if vhost, ok := vh.exact[host]; ok {
+		return vhost
+	}
+	for _, w := range vh.wildcards {
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.vhost
+		}
+	}
+	return vh.fallback
+}
+
+// match returns the virtual host for r, chosen by the Host header or, when
+// that is missing, by the TLS server name. ok is false when the client sent
+// SNI for a different virtual host than its Host header asks for.
+func (vh *virtualHosts) match(r *http.Request) (vhost *virtualHost, ok bool) {
+	host := normalizeHost(r.Host)
+	if r.TLS == nil || r.TLS.ServerName == "" {
+		return vh.lookup(host), true
+	}
+
+	sni := vh.lookup(normalizeHost(r.TLS.ServerName))
+	if host == "" {
+		return sni, true
+	}
+	vhost = vh.lookup(host)
+	return vhost, vhost == sni
+}
+
+// normalizeHost lower cases host and drops any port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// buildHandlers wraps mux in the CORS and rate limiting middleware of every virtual host
+func (rp *ReverseProxy) buildHandlers(mux http.Handler) {
+	for _, vhost := range rp.vhosts.all {
+		cors := vhost.cors
+		rateLimit := vhost.rateLimit
+		vhost.handler = middleware.Chain(mux,
+			middleware.CORSMiddleware(&cors, rp.Logger),
+			middleware.NewRateLimiter(&rateLimit, rp.Logger).Middleware(),
+		)
+	}
+}
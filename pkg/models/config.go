@@ -2,13 +2,225 @@ package models
 
 import "time"
 
+// DefaultUpstream is the name routes use to refer to the top-level backends
+const DefaultUpstream = "default"
+
 type Config struct {
-	Server      ServerConfig      `mapstructure:"server"`
-	Backends    []string          `mapstructure:"backends"`
-	RateLimit   RateLimitConfig   `mapstructure:"rate_limit"`
-	CORS        CORSConfig        `mapstructure:"cors"`
-	Logging     LoggingConfig     `mapstructure:"logging"`
-	HealthCheck HealthCheckConfig `mapstructure:"health_check"`
+	Server        ServerConfig        `mapstructure:"server"`
+	Backends      []Backend           `mapstructure:"backends"`
+	RateLimit     RateLimitConfig     `mapstructure:"rate_limit"`
+	CORS          CORSConfig          `mapstructure:"cors"`
+	Logging       LoggingConfig       `mapstructure:"logging"`
+	HealthCheck   HealthCheckConfig   `mapstructure:"health_check"`
+	LoadBalancing LoadBalancingConfig `mapstructure:"load_balancing"`
+	// OutlierDetection passively ejects backends based on live traffic
+	OutlierDetection OutlierDetectionConfig `mapstructure:"outlier_detection"`
+	CircuitBreaker   CircuitBreakerConfig   `mapstructure:"circuit_breaker"`
+	Retry            RetryConfig            `mapstructure:"retry"`
+	Hedging          HedgingConfig          `mapstructure:"hedging"`
+	Upstream         UpstreamConfig         `mapstructure:"upstream"`
+	// Upstreams are additional named backend pools that routes can send traffic to,
+	// the top-level backends form the pool named "default"
+	Upstreams map[string]PoolConfig `mapstructure:"upstreams"`
+	Routes    []RouteConfig         `mapstructure:"routes"`
+	// VirtualHosts route requests by host name, requests for other hosts use the top-level routes
+	VirtualHosts []VirtualHostConfig `mapstructure:"virtual_hosts"`
+	Admin        AdminConfig         `mapstructure:"admin"`
+}
+
+// AdminConfig protects the endpoints that change the proxy at runtime, they
+// are disabled while Token is empty
+type AdminConfig struct {
+	// Token must be sent as "Authorization: Bearer <token>"
+	Token string `mapstructure:"token"`
+}
+
+// Backend is a single entry of the backends list. Entries may also be written
+// as plain URL strings, in which case the weight defaults to 1.
+type Backend struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// PoolConfig describes a named upstream pool. LoadBalancing and HealthCheck
+// fall back to the top-level sections when left empty.
+type PoolConfig struct {
+	Backends      []Backend           `mapstructure:"backends"`
+	LoadBalancing LoadBalancingConfig `mapstructure:"load_balancing"`
+	HealthCheck   HealthCheckConfig   `mapstructure:"health_check"`
+}
+
+// RouteConfig sends requests matching at most one of Path, Prefix or Regex,
+// and every other condition given, to the named upstream pool. A route without
+// a path matcher behaves like Prefix "/".
+type RouteConfig struct {
+	Name string `mapstructure:"name"`
+	// Path matches the request path exactly
+	Path string `mapstructure:"path"`
+	// Prefix matches whole path segments, so /api matches /api and /api/users but not /apix
+	Prefix string `mapstructure:"prefix"`
+	Regex  string `mapstructure:"regex"`
+	// Methods restricts the route to these HTTP methods
+	Methods []string         `mapstructure:"methods"`
+	Headers []MatchCondition `mapstructure:"headers"`
+	Query   []MatchCondition `mapstructure:"query"`
+	// Upstream names the pool serving the route, empty or "default" selects the top-level backends
+	Upstream string `mapstructure:"upstream"`
+	// RetryNonIdempotent opts methods such as POST and PATCH on this route into retries
+	RetryNonIdempotent bool            `mapstructure:"retry_non_idempotent"`
+	Rewrite            RewriteConfig   `mapstructure:"rewrite"`
+	Split              SplitConfig     `mapstructure:"split"`
+	Mirror             MirrorConfig    `mapstructure:"mirror"`
+	Streaming          StreamingConfig `mapstructure:"streaming"`
+}
+
+// StreamingConfig passes responses on to the client as they arrive instead of
+// as the copy buffer fills. text/event-stream responses are always flushed
+// after every write. Streamed responses are exempt from the server write
+// timeout and the upstream timeout, IdleTimeout limits them instead.
+type StreamingConfig struct {
+	// FlushInterval flushes every response of the route this often, negative flushes after every write
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// IdleTimeout ends a stream that has carried no data for this long
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+}
+
+// MirrorConfig copies a sample of a route's requests to a shadow pool. Shadow
+// requests are sent in the background and their responses are discarded, so
+// they never affect the client.
+type MirrorConfig struct {
+	// Upstream names the pool receiving the copies, empty disables mirroring
+	Upstream string `mapstructure:"upstream"`
+	// Percentage of requests (0-100) that are copied
+	Percentage float64 `mapstructure:"percentage"`
+	// MaxBodyBytes is the largest request body buffered for a copy, requests with larger bodies are not mirrored
+	MaxBodyBytes int64 `mapstructure:"max_body_bytes"`
+	// Header is set to "true" on shadow requests so the shadow service can tell them apart
+	Header string `mapstructure:"header"`
+	// Timeout bounds each shadow request
+	Timeout time.Duration `mapstructure:"timeout"`
+	// MaxInFlight caps concurrent shadow requests, copies beyond it are dropped
+	MaxInFlight int `mapstructure:"max_in_flight"`
+}
+
+// SplitConfig sends a share of a route's traffic to a canary pool instead of
+// the route's upstream. The weight can be changed at runtime through the admin API.
+type SplitConfig struct {
+	// Canary names the upstream pool receiving Weight percent (0-100) of requests
+	Canary string  `mapstructure:"canary"`
+	Weight float64 `mapstructure:"weight"`
+	// OverrideHeader and OverrideCookie force a side when set to canary or stable
+	OverrideHeader string `mapstructure:"override_header"`
+	OverrideCookie string `mapstructure:"override_cookie"`
+	// Sticky keeps each client on one side by hashing StickyHeader, or the client IP when empty
+	Sticky       bool          `mapstructure:"sticky"`
+	StickyHeader string        `mapstructure:"sticky_header"`
+	Rollout      RolloutConfig `mapstructure:"rollout"`
+}
+
+// RolloutConfig lets the proxy step the canary weight up on its own, rolling
+// back to 0 when the canary does noticeably worse than the stable pool
+type RolloutConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Steps are the canary weights applied in order, such as 1, 5, 25 and 100
+	Steps []float64 `mapstructure:"steps"`
+	// Interval is how long each step is held before moving on
+	Interval time.Duration `mapstructure:"interval"`
+	// CheckInterval is how often the two pools are compared
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+	// MinimumRequests the canary needs within a step before it is judged or promoted
+	MinimumRequests int `mapstructure:"minimum_requests"`
+	// MaxErrorRateIncrease rolls back once the canary 5xx rate exceeds the stable one by more than this (0-1)
+	MaxErrorRateIncrease float64 `mapstructure:"max_error_rate_increase"`
+	// MaxLatencyRatio rolls back once the canary p99 latency exceeds the stable one times this,
+	// differences under 5ms are ignored
+	MaxLatencyRatio float64 `mapstructure:"max_latency_ratio"`
+}
+
+// RewriteConfig changes the path and query sent to the backend. At most one of
+// StripPrefix, ReplacePrefix or Regex may be set. Prefixes match whole path
+// segments, and the regex is applied to the escaped path so encoded characters
+// such as %2F are kept.
+type RewriteConfig struct {
+	StripPrefix   string        `mapstructure:"strip_prefix"`
+	ReplacePrefix PrefixRewrite `mapstructure:"replace_prefix"`
+	Regex         RegexRewrite  `mapstructure:"regex"`
+	// SetQuery overrides query parameters, AddQuery appends values to them
+	SetQuery []QueryParam `mapstructure:"set_query"`
+	AddQuery []QueryParam `mapstructure:"add_query"`
+}
+
+type PrefixRewrite struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// RegexRewrite replaces matches of Pattern, Replacement may refer to groups as $1 or ${name}
+type RegexRewrite struct {
+	Pattern     string `mapstructure:"pattern"`
+	Replacement string `mapstructure:"replacement"`
+}
+
+type QueryParam struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+// VirtualHostConfig serves a set of host names with a route table and
+// middleware settings of its own. CORS and RateLimit fall back to the
+// top-level sections when left empty.
+type VirtualHostConfig struct {
+	Name string `mapstructure:"name"`
+	// Hosts are exact names such as api.example.com or wildcards such as
+	// *.example.com, which match any subdomain but not example.com itself
+	Hosts     []string        `mapstructure:"hosts"`
+	Routes    []RouteConfig   `mapstructure:"routes"`
+	CORS      CORSConfig      `mapstructure:"cors"`
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+}
+
+// MatchCondition tests a request header or query parameter by name. At most
+// one of Exact, Prefix, Regex or Absent may be set, with none of them the
+// value only has to be present.
+type MatchCondition struct {
+	Name   string `mapstructure:"name"`
+	Exact  string `mapstructure:"exact"`
+	Prefix string `mapstructure:"prefix"`
+	Regex  string `mapstructure:"regex"`
+	Absent bool   `mapstructure:"absent"`
+}
+
+type LoadBalancingConfig struct {
+	// Strategy selects the balancing algorithm, defaults to round_robin when empty
+	Strategy string `mapstructure:"strategy"`
+	// EWMADecay controls how quickly the p2c strategy forgets old latency samples
+	EWMADecay time.Duration `mapstructure:"ewma_decay"`
+	Hash      HashConfig    `mapstructure:"hash"`
+	Sticky    StickyConfig  `mapstructure:"sticky"`
+}
+
+// StickyConfig enables cookie based session affinity on top of the selected strategy
+type StickyConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	CookieName string `mapstructure:"cookie_name"`
+	// TTL of the cookie, enforced by the proxy as well, zero makes it a session cookie
+	TTL    time.Duration `mapstructure:"ttl"`
+	Secure bool          `mapstructure:"secure"`
+	// SameSite is one of lax, strict or none, defaults to lax
+	SameSite string `mapstructure:"same_site"`
+	// Secret is the HMAC key used to sign the cookie
+	Secret string `mapstructure:"secret"`
+}
+
+// HashConfig selects the request attribute used by the consistent_hash strategy
+type HashConfig struct {
+	// Key is one of header, cookie, path, query or client_ip
+	Key string `mapstructure:"key"`
+	// Name of the header, cookie or query parameter to hash
+	Name string `mapstructure:"name"`
+	// Segment is the 1-based path segment to hash when Key is path
+	Segment      int `mapstructure:"segment"`
+	VirtualNodes int `mapstructure:"virtual_nodes"`
 }
 
 type LoggingConfig struct {
@@ -18,10 +230,109 @@ type LoggingConfig struct {
 }
 
 type HealthCheckConfig struct {
-	Frequency        time.Duration `mapstructure:"frequency"`
-	Timeout          time.Duration `mapstructure:"timeout"`
-	HealthyThreshold int           `mapstructure:"healthy_threshold"`
-	Path             string        `mapstructure:"path"`
+	Frequency time.Duration `mapstructure:"frequency"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+	// Consecutive passes or failures needed before a backend changes state
+	HealthyThreshold   int `mapstructure:"healthy_threshold"`
+	UnhealthyThreshold int `mapstructure:"unhealthy_threshold"`
+	// Path is probed under each backend's own base path
+	Path string `mapstructure:"path"`
+	// ExpectedStatuses accepts codes, classes and ranges such as "200", "2xx" or "200-399"
+	ExpectedStatuses []string `mapstructure:"expected_statuses"`
+	// BodyContains optionally requires the response body to contain this substring
+	BodyContains string `mapstructure:"body_contains"`
+	// GRPC probes backends with the standard grpc.health.v1 Check call instead
+	// of a GET of Path, a backend passes while it reports SERVING
+	GRPC bool `mapstructure:"grpc"`
+	// GRPCService is the service asked about, empty asks about the server as a whole
+	GRPCService string `mapstructure:"grpc_service"`
+}
+
+type OutlierDetectionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// ConsecutiveFailures ejects a backend after this many failures in a row
+	ConsecutiveFailures int `mapstructure:"consecutive_failures"`
+	// FailureRateThreshold ejects a backend whose failure ratio (0-1) within an
+	// interval reaches it, once MinimumRequests have been seen. Zero disables it.
+	FailureRateThreshold float64       `mapstructure:"failure_rate_threshold"`
+	MinimumRequests      int           `mapstructure:"minimum_requests"`
+	Interval             time.Duration `mapstructure:"interval"`
+	// Ejections last BaseEjectionTime times the number of recent ejections, up to MaxEjectionTime
+	BaseEjectionTime time.Duration `mapstructure:"base_ejection_time"`
+	MaxEjectionTime  time.Duration `mapstructure:"max_ejection_time"`
+	// MaxEjectionPercent caps the share of the pool that can be ejected at once
+	MaxEjectionPercent int `mapstructure:"max_ejection_percent"`
+}
+
+type CircuitBreakerConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// ErrorRatio (0-1) within Window that opens the breaker once MinimumRequests have been seen
+	ErrorRatio      float64       `mapstructure:"error_ratio"`
+	MinimumRequests int           `mapstructure:"minimum_requests"`
+	Window          time.Duration `mapstructure:"window"`
+	// OpenDuration is how long an open breaker rejects requests before probing
+	OpenDuration time.Duration `mapstructure:"open_duration"`
+	// HalfOpenProbes is the number of probe requests allowed, and required to succeed, while half-open
+	HalfOpenProbes int `mapstructure:"half_open_probes"`
+}
+
+type RetryConfig struct {
+	// Attempts is the number of retries after the first try, zero disables retries
+	Attempts int `mapstructure:"attempts"`
+	// RetryOn lists response status codes that are retried, connection errors always are
+	RetryOn []int `mapstructure:"retry_on"`
+	// NonIdempotent opts methods such as POST and PATCH into retries
+	NonIdempotent bool `mapstructure:"non_idempotent"`
+	// MaxBodyBytes is the largest request body buffered for replay, larger requests are not retried
+	MaxBodyBytes int64 `mapstructure:"max_body_bytes"`
+	// Backoff grows exponentially from BackoffBase up to BackoffMax, with full jitter
+	BackoffBase time.Duration `mapstructure:"backoff_base"`
+	BackoffMax  time.Duration `mapstructure:"backoff_max"`
+	// BudgetRatio caps retries to this share of requests, with at least
+	// BudgetMinRetries allowed so quiet periods can still retry
+	BudgetRatio      float64 `mapstructure:"budget_ratio"`
+	BudgetMinRetries int     `mapstructure:"budget_min_retries"`
+}
+
+// HedgingConfig duplicates slow idempotent requests onto a second backend
+type HedgingConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Delay before a hedge is sent, also used until a percentile has enough samples
+	Delay time.Duration `mapstructure:"delay"`
+	// Percentile (0-100) of recent per-route latency used as the delay, zero uses Delay only
+	Percentile float64 `mapstructure:"percentile"`
+	// BudgetRatio caps hedges to this share of requests, with at least BudgetMinHedges allowed
+	BudgetRatio     float64 `mapstructure:"budget_ratio"`
+	BudgetMinHedges int     `mapstructure:"budget_min_hedges"`
+}
+
+// UpstreamConfig tunes the pooled transport used for each backend
+type UpstreamConfig struct {
+	DialTimeout           time.Duration `mapstructure:"dial_timeout"`
+	KeepAlive             time.Duration `mapstructure:"keep_alive"`
+	TLSHandshakeTimeout   time.Duration `mapstructure:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `mapstructure:"idle_conn_timeout"`
+	MaxIdleConns          int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `mapstructure:"max_idle_conns_per_host"`
+	// MaxConnsPerHost limits dialled, active and idle connections per backend, zero means no limit
+	MaxConnsPerHost int `mapstructure:"max_conns_per_host"`
+	// HTTP2 negotiates HTTP/2 with TLS backends
+	HTTP2 bool              `mapstructure:"http2"`
+	TLS   UpstreamTLSConfig `mapstructure:"tls"`
+	// TunnelIdleTimeout closes WebSocket and other upgraded connections that
+	// carried no data in either direction for this long
+	TunnelIdleTimeout time.Duration `mapstructure:"tunnel_idle_timeout"`
+}
+
+// UpstreamTLSConfig controls how https backends are verified, by the proxy and by health checks
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string `mapstructure:"ca_file"`
+	// ServerName overrides the name verified against backend certificates
+	ServerName string `mapstructure:"server_name"`
+	// InsecureSkipVerify disables certificate verification, for testing only
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
 }
 
 type CORSConfig struct {
@@ -39,9 +350,45 @@ type ServerConfig struct {
 	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
 	WriteTimeout time.Duration `mapstructure:"write_timeout"`
 	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
+	// H2C accepts cleartext HTTP/2 on the same port as HTTP/1.1
+	H2C H2CConfig `mapstructure:"h2c"`
+	// TLS serves HTTPS on Address once a certificate is set, HTTP/3 uses the same certificate
+	TLS   ServerTLSConfig `mapstructure:"tls"`
+	HTTP3 HTTP3Config     `mapstructure:"http3"`
 	// Optional: Additional server configurations
 	// MaxHeaderBytes int        `mapstructure:"max_header_bytes"`
-	// TLSConfig      *TLSConfig `mapstructure:"tls,omitempty"`
+}
+
+// ServerTLSConfig holds the PEM certificate chain and key the proxy serves TLS with
+type ServerTLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// HTTP3Config runs an HTTP/3 listener over QUIC next to the TCP one, with the
+// same handlers. It needs the server TLS certificate, and responses over TCP
+// advertise it with an Alt-Svc header.
+type HTTP3Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Address is the UDP address to listen on, defaults to the server address
+	Address string `mapstructure:"address"`
+	// IdleTimeout closes QUIC connections without any traffic for this long, defaults to 30s
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// MaxStreams limits the requests a client may have open on one connection, defaults to 100
+	MaxStreams int64 `mapstructure:"max_streams"`
+}
+
+// H2CConfig enables cleartext HTTP/2 for clients that start with the HTTP/2
+// preface (prior knowledge) or ask to upgrade with "Upgrade: h2c". Zero values
+// keep the HTTP/2 defaults.
+type H2CConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxConcurrentStreams limits the requests a client may have open on one connection
+	MaxConcurrentStreams uint32 `mapstructure:"max_concurrent_streams"`
+	// StreamWindowSize and ConnWindowSize are the flow control windows, in
+	// bytes, for request bodies of one stream and of the whole connection
+	StreamWindowSize int32 `mapstructure:"stream_window_size"`
+	ConnWindowSize   int32 `mapstructure:"conn_window_size"`
 }
 
 type BackendServerConfig struct {
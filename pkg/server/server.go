@@ -16,8 +16,10 @@ import (
 	"go.uber.org/zap"
 )
 
-// gracefulShutdown handles server shutdown upon receiving termination signals
-func GracefulShutdown(server *http.Server, logger *zap.Logger) error {
+// gracefulShutdown handles server shutdown upon receiving termination signals.
+// Connections the server no longer tracks, such as hijacked WebSocket tunnels,
+// are drained afterwards by the drain functions within the same deadline.
+func GracefulShutdown(server *http.Server, logger *zap.Logger, drains ...func(context.Context) error) error {
 	// Create a channel to listen for OS signals
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
@@ -30,9 +32,19 @@ func GracefulShutdown(server *http.Server, logger *zap.Logger) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Attempt graceful shutdown
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Fatal("Server forced to shutdown", zap.Error(err))
+	// Attempt graceful shutdown, the drains still get their turn if it times out
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Error("Server forced to shutdown", zap.Error(err))
+		server.Close()
+	}
+	for _, drain := range drains {
+		if err := drain(ctx); err != nil {
+			logger.Warn("Forced open connections closed", zap.Error(err))
+		}
+	}
+	if err != nil {
+		return err
 	}
 
 	logger.Info("Server exiting gracefully")
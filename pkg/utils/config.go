@@ -5,7 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"http-reverse-proxy/pkg/models"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -22,13 +27,27 @@ func LoadConfig(path string) (*models.Config, error) {
 	}
 
 	var config models.Config
-	if err := v.Unmarshal(&config); err != nil {
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		backendDecodeHook,
+	))
+	if err := v.Unmarshal(&config, decodeHook); err != nil {
 		return nil, fmt.Errorf("unmarshalling config: %w", err)
 	}
 
 	return &config, nil
 }
 
+// backendDecodeHook keeps plain string entries in the backends list working
+// alongside the structured url/weight form
+func backendDecodeHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(models.Backend{}) {
+		return data, nil
+	}
+	return models.Backend{URL: data.(string), Weight: 1}, nil
+}
+
 // LoadBackendConfig is used to load backend pool configs for testing
 func LoadBackendConfig(path string) (*models.BackendConfig, error) {
 	v := viper.New()
@@ -49,6 +68,100 @@ func LoadBackendConfig(path string) (*models.BackendConfig, error) {
 	return &config, nil
 }
 
+func validateBackends(backends []models.Backend) error {
+	for _, backend := range backends {
+		if backend.URL == "" {
+			return errors.New("backend url is required")
+		}
+		parsed, err := url.Parse(backend.URL)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", backend.URL, err)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != SchemeH2C) || parsed.Host == "" {
+			return fmt.Errorf("backend %s: url must be absolute with an http, https or h2c scheme", backend.URL)
+		}
+		if backend.Weight < 0 {
+			return fmt.Errorf("backend %s: weight must not be negative", backend.URL)
+		}
+	}
+	return nil
+}
+
+func validateCondition(condition models.MatchCondition) error {
+	if condition.Name == "" {
+		return errors.New("match condition name is required")
+	}
+	tests := 0
+	for _, set := range []bool{condition.Exact != "", condition.Prefix != "", condition.Regex != "", condition.Absent} {
+		if set {
+			tests++
+		}
+	}
+	if tests > 1 {
+		return fmt.Errorf("match condition %s: only one of exact, prefix, regex or absent may be set", condition.Name)
+	}
+	return nil
+}
+
+func validateRoutes(routes []models.RouteConfig, upstreams map[string]models.PoolConfig) error {
+	for i, route := range routes {
+		matchers := 0
+		for _, m := range []string{route.Path, route.Prefix, route.Regex} {
+			if m != "" {
+				matchers++
+			}
+		}
+		if matchers > 1 {
+			return fmt.Errorf("route %d: only one of path, prefix or regex may be set", i)
+		}
+		rewrites := 0
+		for _, set := range []bool{route.Rewrite.StripPrefix != "", route.Rewrite.ReplacePrefix.From != "", route.Rewrite.Regex.Pattern != ""} {
+			if set {
+				rewrites++
+			}
+		}
+		if rewrites > 1 {
+			return fmt.Errorf("route %d: only one of strip_prefix, replace_prefix or regex rewrites may be set", i)
+		}
+		for _, condition := range append(slices.Clone(route.Headers), route.Query...) {
+			if err := validateCondition(condition); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if _, ok := upstreams[route.Upstream]; !ok && route.Upstream != "" && route.Upstream != models.DefaultUpstream {
+			return fmt.Errorf("route %d: unknown upstream %q", i, route.Upstream)
+		}
+		if split := route.Split; split.Canary != "" {
+			if _, ok := upstreams[split.Canary]; !ok && split.Canary != models.DefaultUpstream {
+				return fmt.Errorf("route %d: unknown canary upstream %q", i, split.Canary)
+			}
+			if split.Weight < 0 || split.Weight > 100 {
+				return fmt.Errorf("route %d: split weight must be between 0 and 100", i)
+			}
+			if route.Name == "" {
+				return fmt.Errorf("route %d: routes with a split need a name", i)
+			}
+			for _, step := range split.Rollout.Steps {
+				if step < 0 || step > 100 {
+					return fmt.Errorf("route %d: rollout steps must be between 0 and 100", i)
+				}
+			}
+			if split.Rollout.Enabled && len(split.Rollout.Steps) == 0 {
+				return fmt.Errorf("route %d: rollout needs at least one step", i)
+			}
+		}
+		if mirror := route.Mirror; mirror.Upstream != "" {
+			if _, ok := upstreams[mirror.Upstream]; !ok && mirror.Upstream != models.DefaultUpstream {
+				return fmt.Errorf("route %d: unknown mirror upstream %q", i, mirror.Upstream)
+			}
+			if mirror.Percentage < 0 || mirror.Percentage > 100 {
+				return fmt.Errorf("route %d: mirror percentage must be between 0 and 100", i)
+			}
+		}
+	}
+	return nil
+}
+
 func ValidateConfig(cfg *models.Config) error {
 	if cfg.Server.Address == "" {
 		return errors.New("server address is required")
@@ -58,6 +171,61 @@ func ValidateConfig(cfg *models.Config) error {
 		return errors.New("at least one backend is required")
 	}
 
+	if err := validateBackends(cfg.Backends); err != nil {
+		return err
+	}
+
+	for name, pool := range cfg.Upstreams {
+		if name == models.DefaultUpstream {
+			return fmt.Errorf("upstream name %q is reserved for the top-level backends", name)
+		}
+		if len(pool.Backends) == 0 {
+			return fmt.Errorf("upstream %s: at least one backend is required", name)
+		}
+		if err := validateBackends(pool.Backends); err != nil {
+			return fmt.Errorf("upstream %s: %w", name, err)
+		}
+	}
+
+	if err := validateRoutes(cfg.Routes, cfg.Upstreams); err != nil {
+		return err
+	}
+
+	hosts := make(map[string]bool)
+	for i, vhost := range cfg.VirtualHosts {
+		if len(vhost.Hosts) == 0 {
+			return fmt.Errorf("virtual host %d: at least one host is required", i)
+		}
+		for _, host := range vhost.Hosts {
+			host = strings.ToLower(host)
+			if hosts[host] {
+				return fmt.Errorf("virtual host %d: host %s is already served by another virtual host", i, host)
+			}
+			hosts[host] = true
+		}
+		if err := validateRoutes(vhost.Routes, cfg.Upstreams); err != nil {
+			return fmt.Errorf("virtual host %d: %w", i, err)
+		}
+	}
+
+	if cfg.Server.H2C.StreamWindowSize < 0 {
+		return errors.New("server.h2c.stream_window_size must not be negative")
+	}
+	// HTTP/2 connections start with a 64KiB window, which can only grow
+	if h2c := cfg.Server.H2C; h2c.ConnWindowSize != 0 && h2c.ConnWindowSize < 65535 {
+		return errors.New("server.h2c.conn_window_size must be at least 65535")
+	}
+
+	if (cfg.Server.TLS.CertFile == "") != (cfg.Server.TLS.KeyFile == "") {
+		return errors.New("server.tls needs both cert_file and key_file")
+	}
+	if cfg.Server.HTTP3.Enabled && cfg.Server.TLS.CertFile == "" {
+		return errors.New("server.http3 needs a certificate in server.tls")
+	}
+	if cfg.Server.HTTP3.IdleTimeout < 0 || cfg.Server.HTTP3.MaxStreams < 0 {
+		return errors.New("server.http3 idle_timeout and max_streams must not be negative")
+	}
+
 	if cfg.RateLimit.RequestsPerMinute <= 0 {
 		return errors.New("rate_limit.requests_per_minute must be positive")
 	}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"http-reverse-proxy/pkg/models"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// SchemeH2C marks backends that speak HTTP/2 over plain TCP with prior
+// knowledge, as gRPC servers without TLS do
+const SchemeH2C = "h2c"
+
+// H2CTransport returns an HTTP/2 transport that talks to h2c backends, dialling
+// plain connections with dialer. Requests sent through it use the http scheme.
+func H2CTransport(dialer *net.Dialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// RequestScheme returns the scheme requests to a backend URL are sent with,
+// h2c backends are reached with http URLs over an h2c transport
+func RequestScheme(u *url.URL) string {
+	switch u.Scheme {
+	case "":
+		return "http"
+	case SchemeH2C:
+		return "http"
+	}
+	return u.Scheme
+}
+
+// EnableH2C lets server accept cleartext HTTP/2, by prior knowledge or by
+// upgrading an HTTP/1.1 request, while still serving HTTP/1.1 on the same
+// port. Shutting server down sends a GOAWAY to its HTTP/2 connections.
+func EnableH2C(server *http.Server, config models.H2CConfig) error {
+	if !config.Enabled {
+		return nil
+	}
+	h2s := &http2.Server{
+		MaxConcurrentStreams:         config.MaxConcurrentStreams,
+		MaxUploadBufferPerStream:     config.StreamWindowSize,
+		MaxUploadBufferPerConnection: config.ConnWindowSize,
+	}
+	// Registers the connections ServeConn takes over for graceful shutdown
+	// and fills in defaults such as the idle timeout from server. It also
+	// prepares a TLS config, which must not turn a plain server into a TLS one.
+	plain := server.TLSConfig == nil
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		return err
+	}
+	if plain {
+		server.TLSConfig = nil
+	}
+	server.Handler = h2c.NewHandler(server.Handler, h2s)
+	return nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"errors"
+	"http-reverse-proxy/pkg/models"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// EnableHTTP3 returns an HTTP/3 server for the handler of server, sharing its
+// TLS certificate, and makes server's responses advertise it with Alt-Svc. The
+// returned server still has to be started, it is nil when HTTP/3 is disabled.
+func EnableHTTP3(server *http.Server, config models.HTTP3Config) (*http3.Server, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if server.TLSConfig == nil {
+		return nil, errors.New("http3 needs the server TLS certificate")
+	}
+	if config.Address == "" {
+		config.Address = server.Addr
+	}
+
+	h3 := &http3.Server{
+		Addr:           config.Address,
+		Handler:        server.Handler,
+		TLSConfig:      server.TLSConfig.Clone(),
+		MaxHeaderBytes: server.MaxHeaderBytes,
+		IdleTimeout:    server.IdleTimeout,
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout:     config.IdleTimeout,
+			MaxIncomingStreams: config.MaxStreams,
+		},
+	}
+
+	next := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fails until the QUIC listener is up, the response goes without it then
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+	return h3, nil
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"os"
+)
+
+// ServerTLSConfig loads the certificate the proxy serves TLS with, it returns
+// nil when none is configured
+func ServerTLSConfig(cfg models.ServerTLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// UpstreamTLSConfig builds the client TLS config used to talk to https backends,
+// trusting the system roots plus the configured CA bundle
+func UpstreamTLSConfig(cfg models.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading upstream CA file: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.New("upstream CA file contains no certificates")
+	}
+	tlsConfig.RootCAs = roots
+
+	return tlsConfig, nil
+}
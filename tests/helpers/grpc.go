@@ -0,0 +1,173 @@
+// tests/helpers/grpc.go
+
+package helpers
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// GRPCBackend is an in-process gRPC server for the test.Echo service, served
+// over h2c or over TLS, with the standard health service registered.
+//
+// test.Echo has the following methods, all taking and returning StringValue messages:
+//   - Echo answers with the request prefixed with the backend name, sets the
+//     "x-backend" header and an "x-deadline" trailer holding the milliseconds
+//     left until the call's deadline, or "none"
+//   - Fail answers with NOT_FOUND
+//   - Slow waits for the call's deadline
+//   - Count streams as many answers as the request asks for, then sets an "x-count" trailer
+type GRPCBackend struct {
+	// URL is the backend URL to configure the proxy with, h2c:// or https://
+	URL    string
+	Name   string
+	Health *health.Server
+
+	server *grpc.Server
+	tls    *httptest.Server
+}
+
+// NewGRPCBackend starts a gRPC backend, over TLS with a self-signed
+// certificate if useTLS is set and over h2c otherwise.
+func NewGRPCBackend(name string, useTLS bool) *GRPCBackend {
+	backend := &GRPCBackend{Name: name, Health: health.NewServer(), server: grpc.NewServer()}
+	backend.server.RegisterService(&echoServiceDesc, backend)
+	healthpb.RegisterHealthServer(backend.server, backend.Health)
+
+	if useTLS {
+		backend.tls = httptest.NewUnstartedServer(backend.server)
+		backend.tls.EnableHTTP2 = true
+		backend.tls.StartTLS()
+		backend.URL = backend.tls.URL
+		return backend
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("helpers: failed to listen: %v", err))
+	}
+	go backend.server.Serve(listener)
+	backend.URL = "h2c://" + listener.Addr().String()
+	return backend
+}
+
+// Certificate returns the certificate of a TLS backend, nil over h2c.
+func (gb *GRPCBackend) Certificate() *x509.Certificate {
+	if gb.tls == nil {
+		return nil
+	}
+	return gb.tls.Certificate()
+}
+
+// Close shuts down the backend.
+func (gb *GRPCBackend) Close() {
+	if gb.tls != nil {
+		gb.tls.Close()
+	}
+	gb.server.Stop()
+}
+
+func (gb *GRPCBackend) echo(ctx context.Context, in *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	remaining := "none"
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining = strconv.FormatInt(time.Until(deadline).Milliseconds(), 10)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-backend", gb.Name))
+	grpc.SetTrailer(ctx, metadata.Pairs("x-deadline", remaining))
+	return wrapperspb.String(gb.Name + ": " + in.GetValue()), nil
+}
+
+func (gb *GRPCBackend) count(in *wrapperspb.StringValue, stream grpc.ServerStream) error {
+	n, err := strconv.Atoi(in.GetValue())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "not a number")
+	}
+	for i := 1; i <= n; i++ {
+		if err := stream.SendMsg(wrapperspb.String(strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	stream.SetTrailer(metadata.Pairs("x-count", strconv.Itoa(n)))
+	return nil
+}
+
+// echoService lets the hand-written service description below be registered without generated code
+type echoService interface{}
+
+func unaryHandler(call func(gb *GRPCBackend, ctx context.Context, in *wrapperspb.StringValue) (*wrapperspb.StringValue, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		in := new(wrapperspb.StringValue)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		return call(srv.(*GRPCBackend), ctx, in)
+	}
+}
+
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*echoService)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Echo", Handler: unaryHandler((*GRPCBackend).echo)},
+		{MethodName: "Fail", Handler: unaryHandler(func(*GRPCBackend, context.Context, *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+			return nil, status.Error(codes.NotFound, "no such thing")
+		})},
+		{MethodName: "Slow", Handler: unaryHandler(func(_ *GRPCBackend, ctx context.Context, _ *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+			<-ctx.Done()
+			return nil, status.FromContextError(ctx.Err()).Err()
+		})},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Count",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				in := new(wrapperspb.StringValue)
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(*GRPCBackend).count(in, stream)
+			},
+		},
+	},
+}
+
+// GRPCCount calls test.Echo/Count on conn and returns the streamed answers and the trailer.
+func GRPCCount(ctx context.Context, conn *grpc.ClientConn, n int) ([]string, metadata.MD, error) {
+	stream, err := conn.NewStream(ctx, &echoServiceDesc.Streams[0], "/test.Echo/Count")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := stream.SendMsg(wrapperspb.String(strconv.Itoa(n))); err != nil {
+		return nil, nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, nil, err
+	}
+	var answers []string
+	for {
+		out := new(wrapperspb.StringValue)
+		err := stream.RecvMsg(out)
+		if err == io.EOF {
+			return answers, stream.Trailer(), nil
+		}
+		if err != nil {
+			return answers, stream.Trailer(), err
+		}
+		answers = append(answers, out.GetValue())
+	}
+}
@@ -0,0 +1,107 @@
+// tests/helpers/h2c.go
+
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// H2CUpgradeResult is what a server answered to an "Upgrade: h2c" request.
+type H2CUpgradeResult struct {
+	// Upgrade is the HTTP/1.1 response to the upgrade request itself
+	Upgrade *http.Response
+	// Settings are the server's HTTP/2 settings
+	Settings map[http2.SettingID]uint32
+	// ConnWindowIncrement is how far the server grew the connection window before answering
+	ConnWindowIncrement uint32
+	// Status and Body are the answer to the upgraded request, sent on stream 1
+	Status int
+	Body   string
+}
+
+// H2CUpgrade sends a GET for path to addr asking to upgrade to h2c and, if the
+// server switches protocols, reads its answer as HTTP/2 frames.
+func H2CUpgrade(addr, path string) (*H2CUpgradeResult, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// An empty settings payload keeps the defaults
+	settings := base64.RawURLEncoding.EncodeToString(nil)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n", path, addr, settings)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &H2CUpgradeResult{Upgrade: resp, Settings: make(map[http2.SettingID]uint32)}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return result, nil
+	}
+
+	// The client speaks HTTP/2 from here on, starting with the preface
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		return nil, err
+	}
+	framer := http2.NewFramer(conn, reader)
+	if err := framer.WriteSettings(); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	decoder := hpack.NewDecoder(4096, func(field hpack.HeaderField) {
+		if field.Name == ":status" {
+			result.Status, _ = strconv.Atoi(field.Value)
+		}
+	})
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if frame.IsAck() {
+				continue
+			}
+			frame.ForeachSetting(func(s http2.Setting) error {
+				result.Settings[s.ID] = s.Val
+				return nil
+			})
+			framer.WriteSettingsAck()
+		case *http2.WindowUpdateFrame:
+			if frame.StreamID == 0 {
+				result.ConnWindowIncrement += frame.Increment
+			}
+		case *http2.HeadersFrame:
+			if _, err := decoder.Write(frame.HeaderBlockFragment()); err != nil {
+				return nil, err
+			}
+			if frame.StreamEnded() {
+				return result, nil
+			}
+		case *http2.DataFrame:
+			body.Write(frame.Data())
+			if frame.StreamEnded() {
+				result.Body = body.String()
+				return result, nil
+			}
+		case *http2.GoAwayFrame:
+			return nil, fmt.Errorf("server sent GOAWAY: %v", frame.ErrCode)
+		}
+	}
+}
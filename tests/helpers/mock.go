@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -22,6 +23,7 @@ type MockBackend struct {
 	DynamicResponseFn func(r *http.Request) (int, string, map[string]string) // Customize responses.
 	mu                sync.Mutex
 	Logger            *zap.Logger
+	requestCount      atomic.Int64
 }
 
 // Close shuts down the mock backend server.
@@ -40,6 +42,15 @@ func (mb *MockBackend) SetStaticResponse(status int, response string, headers ma
 
 // NewMockBackend creates and starts a new mock backend server with optional headers.
 func NewMockBackend(status int, response string, headers map[string]string, logger *zap.Logger) *MockBackend {
+	return newMockBackend(status, response, headers, logger, httptest.NewServer)
+}
+
+// NewMockTLSBackend is like NewMockBackend but serves HTTPS with a self-signed certificate.
+func NewMockTLSBackend(status int, response string, headers map[string]string, logger *zap.Logger) *MockBackend {
+	return newMockBackend(status, response, headers, logger, httptest.NewTLSServer)
+}
+
+func newMockBackend(status int, response string, headers map[string]string, logger *zap.Logger, start func(http.Handler) *httptest.Server) *MockBackend {
 	backend := &MockBackend{
 		RequestCh: make(chan *http.Request, 100),
 		Status:    status,
@@ -49,23 +60,61 @@ func NewMockBackend(status int, response string, headers map[string]string, logg
 	}
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backend.requestCount.Add(1)
+
+		backend.mu.Lock()
+		// Stop buffering once the channel is full, busy benchmarks would otherwise block here.
+		select {
+		case backend.RequestCh <- r:
+		default:
+		}
+		delay := backend.Delay
+		backend.mu.Unlock()
+
+		// Simulate a slow backend if requested.
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
 		backend.mu.Lock()
-		backend.RequestCh <- r
+		status, response, headers := backend.Status, backend.Response, backend.Headers
+		if backend.DynamicResponseFn != nil {
+			status, response, headers = backend.DynamicResponseFn(r)
+		}
 		backend.mu.Unlock()
 
 		// Set headers if any.
-		for key, value := range backend.Headers {
+		for key, value := range headers {
 			w.Header().Set(key, value)
 		}
 
-		w.WriteHeader(backend.Status)
-		w.Write([]byte(backend.Response))
+		w.WriteHeader(status)
+		w.Write([]byte(response))
 	})
 
-	backend.Server = httptest.NewServer(handler)
+	backend.Server = start(handler)
 	return backend
 }
 
+// SetDelay configures an artificial delay applied before each response.
+func (mb *MockBackend) SetDelay(delay time.Duration) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.Delay = delay
+}
+
+// RequestCount returns the total number of requests received, including ones no longer buffered.
+func (mb *MockBackend) RequestCount() int64 {
+	return mb.requestCount.Load()
+}
+
+// SetDynamicResponse configures a function that computes the response for each request.
+func (mb *MockBackend) SetDynamicResponse(fn func(r *http.Request) (int, string, map[string]string)) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.DynamicResponseFn = fn
+}
+
 // GetRequests retrieves all received requests.
 func (mb *MockBackend) GetRequests() []*http.Request {
 	mb.mu.Lock()
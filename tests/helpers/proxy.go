@@ -22,7 +22,7 @@ import (
 
 // SetupProxy initializes the reverse proxy with given backend URLs and configuration overrides.
 // It returns the running HTTP server and a teardown function to gracefully shutdown the server.
-func SetupProxy(t *testing.T, backendURLs []string, configOverrides map[string]interface{}) (*http.Server, func()) {
+func SetupProxy(t testing.TB, backendURLs []string, configOverrides map[string]interface{}) (*http.Server, func()) {
 	// Load default config.
 	// Assuming tests are run from the project root.
 	absPath, err := filepath.Abs(filepath.Join("..", "..", "configs", "config.yaml"))
@@ -36,41 +36,105 @@ func SetupProxy(t *testing.T, backendURLs []string, configOverrides map[string]i
 	if addr, ok := configOverrides["address"].(string); ok {
 		config.Server.Address = addr
 	}
+	if readTimeout, ok := configOverrides["readTimeout"].(time.Duration); ok {
+		config.Server.ReadTimeout = readTimeout
+	}
+	if writeTimeout, ok := configOverrides["writeTimeout"].(time.Duration); ok {
+		config.Server.WriteTimeout = writeTimeout
+	}
+	if h2cCfg, ok := configOverrides["h2c"].(models.H2CConfig); ok {
+		config.Server.H2C = h2cCfg
+	}
+	if tlsCfg, ok := configOverrides["serverTLS"].(models.ServerTLSConfig); ok {
+		config.Server.TLS = tlsCfg
+	}
+	if http3Cfg, ok := configOverrides["http3"].(models.HTTP3Config); ok {
+		config.Server.HTTP3 = http3Cfg
+	}
 	if corsCfg, ok := configOverrides["cors"].(models.CORSConfig); ok {
 		config.CORS = corsCfg
 	}
 	if rateLimitCfg, ok := configOverrides["ratelimit"].(models.RateLimitConfig); ok {
 		config.RateLimit = rateLimitCfg
 	}
+	if healthCheckCfg, ok := configOverrides["healthCheck"].(models.HealthCheckConfig); ok {
+		config.HealthCheck = healthCheckCfg
+	}
 	if healthCheckFreq, ok := configOverrides["healthCheckFreq"].(time.Duration); ok {
 		config.HealthCheck.Frequency = healthCheckFreq
 	}
+	if strategy, ok := configOverrides["strategy"].(string); ok {
+		config.LoadBalancing.Strategy = strategy
+	}
+	if ewmaDecay, ok := configOverrides["ewmaDecay"].(time.Duration); ok {
+		config.LoadBalancing.EWMADecay = ewmaDecay
+	}
+	if hashCfg, ok := configOverrides["hash"].(models.HashConfig); ok {
+		config.LoadBalancing.Hash = hashCfg
+	}
+	if stickyCfg, ok := configOverrides["sticky"].(models.StickyConfig); ok {
+		config.LoadBalancing.Sticky = stickyCfg
+	}
+	if outlierCfg, ok := configOverrides["outlierDetection"].(models.OutlierDetectionConfig); ok {
+		config.OutlierDetection = outlierCfg
+	}
+	if breakerCfg, ok := configOverrides["circuitBreaker"].(models.CircuitBreakerConfig); ok {
+		config.CircuitBreaker = breakerCfg
+	}
+	if retryCfg, ok := configOverrides["retry"].(models.RetryConfig); ok {
+		config.Retry = retryCfg
+	}
+	if hedgingCfg, ok := configOverrides["hedging"].(models.HedgingConfig); ok {
+		config.Hedging = hedgingCfg
+	}
+	if upstreamCfg, ok := configOverrides["upstream"].(models.UpstreamConfig); ok {
+		config.Upstream = upstreamCfg
+	}
+	if upstreams, ok := configOverrides["upstreams"].(map[string]models.PoolConfig); ok {
+		config.Upstreams = upstreams
+	}
+	if routes, ok := configOverrides["routes"].([]models.RouteConfig); ok {
+		config.Routes = routes
+	}
+	if vhosts, ok := configOverrides["virtualHosts"].([]models.VirtualHostConfig); ok {
+		config.VirtualHosts = vhosts
+	}
+	if adminCfg, ok := configOverrides["admin"].(models.AdminConfig); ok {
+		config.Admin = adminCfg
+	}
 
 	// The default ocnfig don't have the settings we want
-	config.Backends = backendURLs
+	config.Backends = make([]models.Backend, 0, len(backendURLs))
+	for _, backendURL := range backendURLs {
+		config.Backends = append(config.Backends, models.Backend{URL: backendURL, Weight: 1})
+	}
+	if backends, ok := configOverrides["backends"].([]models.Backend); ok {
+		config.Backends = backends
+	}
 
-	// Initialize logger.
-	zapLogger, err := logger.NewZapLogger(config.Logging.Level)
-	assert.NoError(t, err, "Failed to initialize logger")
+	// Initialize logger, unless the test wants to capture the logs itself.
+	zapLogger, ok := configOverrides["logger"].(*zap.Logger)
+	if !ok {
+		zapLogger, err = logger.NewZapLogger(config.Logging.Level)
+		assert.NoError(t, err, "Failed to initialize logger")
+	}
 
 	// Initialize load balancer.
-	lb, err := loadbalancer.NewRoundRobin(config, zapLogger)
+	lb, err := loadbalancer.New(config, zapLogger)
 	assert.NoError(t, err, "Failed to initialize load balancer")
 
 	// Initialize reverse proxy handler.
 	proxyHandler, err := proxy.NewReverseProxy(lb, zapLogger, config)
 	assert.NoError(t, err, "Failed to initialize proxy handler")
 
-	// Setup routes.
+	// Setup routes, CORS and rate limiting are applied per virtual host.
 	router := proxyHandler.SetupRoutes()
 
 	// Initialize middlewares.
 	loggingMiddleware := middleware.LoggingMiddleware(zapLogger)
-	corsMiddleware := middleware.CORSMiddleware(&config.CORS, zapLogger)
-	rateLimiterMiddleware := middleware.NewRateLimiter(&config.RateLimit, zapLogger).Middleware()
 
 	// Chain middlewares.
-	chainedHandler := middleware.Chain(router, loggingMiddleware, corsMiddleware, rateLimiterMiddleware)
+	chainedHandler := middleware.Chain(router, loggingMiddleware)
 
 	// Create HTTP server.
 	httpServer := &http.Server{
@@ -80,6 +144,13 @@ func SetupProxy(t *testing.T, backendURLs []string, configOverrides map[string]i
 		WriteTimeout: config.Server.WriteTimeout,
 		IdleTimeout:  config.Server.IdleTimeout,
 	}
+	// Streams have no write timeout, end them so shutting down need not wait on them
+	httpServer.RegisterOnShutdown(proxyHandler.CloseStreams)
+	httpServer.TLSConfig, err = utils.ServerTLSConfig(config.Server.TLS)
+	assert.NoError(t, err, "Failed to load TLS certificate")
+	h3Server, err := utils.EnableHTTP3(httpServer, config.Server.HTTP3)
+	assert.NoError(t, err, "Failed to enable HTTP/3")
+	assert.NoError(t, utils.EnableH2C(httpServer, config.Server.H2C), "Failed to enable h2c")
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -87,10 +158,23 @@ func SetupProxy(t *testing.T, backendURLs []string, configOverrides map[string]i
 	// Start server in a goroutine.
 	go func() {
 		wg.Done()
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if httpServer.TLSConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			zapLogger.Fatal("ListenAndServe failed", zap.Error(err))
 		}
 	}()
+	if h3Server != nil {
+		go func() {
+			if err := h3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				zapLogger.Fatal("HTTP/3 ListenAndServe failed", zap.Error(err))
+			}
+		}()
+	}
 
 	// Wait for server to start.
 	wg.Wait()
@@ -102,6 +186,11 @@ func SetupProxy(t *testing.T, backendURLs []string, configOverrides map[string]i
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		httpServer.Shutdown(ctx)
+		if h3Server != nil {
+			h3Server.Shutdown(ctx)
+		}
+		proxyHandler.Shutdown(ctx)
+		proxyHandler.Close()
 	}
 
 	return httpServer, teardown
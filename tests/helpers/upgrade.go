@@ -0,0 +1,102 @@
+// tests/helpers/upgrade.go
+
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+)
+
+// UpgradeBackend is a mock backend that switches to a line based echo protocol
+// when asked to upgrade to "echo". Each line is answered prefixed with the
+// backend name, and once the client stops sending it says "bye" and hangs up.
+type UpgradeBackend struct {
+	Server  *httptest.Server
+	Name    string
+	tunnels atomic.Int64
+}
+
+// NewUpgradeBackend starts an echo backend that names itself in its answers.
+func NewUpgradeBackend(name string) *UpgradeBackend {
+	backend := &UpgradeBackend{Name: name}
+	backend.Server = httptest.NewServer(http.HandlerFunc(backend.serve))
+	return backend
+}
+
+// Close shuts down the backend.
+func (ub *UpgradeBackend) Close() {
+	ub.Server.Close()
+}
+
+// Tunnels returns the number of upgraded connections currently open.
+func (ub *UpgradeBackend) Tunnels() int64 {
+	return ub.tunnels.Load()
+}
+
+func (ub *UpgradeBackend) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		w.Write([]byte("OK"))
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "echo") {
+		http.Error(w, "upgrade to echo required", http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ub.tunnels.Add(1)
+	defer ub.tunnels.Add(-1)
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Path: %s\r\n\r\n", r.URL.Path)
+	rw.Flush()
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(rw, "%s: %s", ub.Name, line)
+		rw.Flush()
+	}
+	rw.WriteString("bye\n")
+	rw.Flush()
+}
+
+// DialUpgrade opens a connection to addr and asks to upgrade path to protocol.
+// It returns the connection, a reader holding anything sent after the response,
+// and the response itself.
+func DialUpgrade(addr, path, protocol string) (net.Conn, *bufio.Reader, *http.Response, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, reader, resp, nil
+}
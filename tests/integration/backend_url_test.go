@@ -0,0 +1,97 @@
+package integration
+
+import (
+	"encoding/pem"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendBasePathsAndSchemes(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// An HTTPS backend mounted under /app with a query of its own, and a plain
+	// HTTP one mounted under /base. Both echo the scheme and request target.
+	secure := helpers.NewMockTLSBackend(200, "OK", nil, logger)
+	defer secure.Close()
+
+	plain := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer plain.Close()
+
+	echo := func(r *http.Request) (int, string, map[string]string) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		return 200, scheme + " " + r.RequestURI, nil
+	}
+	secure.SetDynamicResponse(echo)
+	plain.SetDynamicResponse(echo)
+
+	// Trust the self-signed certificate of the HTTPS backend.
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0o600), "Failed to write CA file")
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"upstream":  models.UpstreamConfig{HTTP2: true, TLS: models.UpstreamTLSConfig{CAFile: caFile}},
+		"backends":  []models.Backend{{URL: secure.Server.URL + "/app/?tenant=acme"}},
+		"upstreams": map[string]models.PoolConfig{
+			"files": {Backends: []models.Backend{{URL: plain.Server.URL + "/base"}}},
+		},
+		"routes": []models.RouteConfig{
+			{
+				Prefix:   "/svc/files",
+				Upstream: "files",
+				Rewrite:  models.RewriteConfig{StripPrefix: "/svc/files"},
+			},
+		},
+	}
+
+	// Setup proxy server, the HTTPS backend has to pass its health check over TLS to start.
+	httpServer, teardown := helpers.SetupProxy(t, nil, configOverrides)
+	defer teardown()
+
+	// Health checks are sent under the base path too.
+	for _, backend := range []struct {
+		mock     *helpers.MockBackend
+		expected string
+	}{{secure, "/app/health"}, {plain, "/base/health"}} {
+		requests := backend.mock.GetRequests()
+		if assert.NotEmpty(t, requests, "Expected a startup health check") {
+			assert.Equal(t, backend.expected, requests[0].URL.Path, "Unexpected health check path")
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"https base path", "/users/1", "https /app/users/1?tenant=acme"},
+		{"https root", "/", "https /app/?tenant=acme"},
+		{"https merged query", "/search?q=go&page=2", "https /app/search?tenant=acme&q=go&page=2"},
+		{"https encoded slash", "/files/a%2Fb", "https /app/files/a%2Fb?tenant=acme"},
+		{"http base path without slash", "/svc/files/docs/readme", "http /base/docs/readme"},
+		{"http base path root", "/svc/files", "http /base/"},
+		{"http base path encoded slash", "/svc/files/a%2Fb", "http /base/a%2Fb"},
+	}
+
+	for _, tc := range testCases {
+		resp, err := http.Get("http://" + httpServer.Addr + tc.path)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "Failed to read response body")
+		assert.Equal(t, tc.expected, string(body), "Unexpected backend request for %s", tc.name)
+	}
+}
@@ -0,0 +1,257 @@
+package integration
+
+import (
+	"encoding/json"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{
+			RequestsPerMinute: 6000,
+			Burst:             100,
+		},
+		"circuitBreaker": models.CircuitBreakerConfig{
+			Enabled:         true,
+			ErrorRatio:      0.5,
+			MinimumRequests: 2,
+			Window:          time.Minute,
+			OpenDuration:    time.Second,
+			HalfOpenProbes:  1,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	// Backend B keeps passing its health check but fails real traffic.
+	backendB.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		if r.URL.Path == "/health" {
+			return 200, "OK", nil
+		}
+		return 500, "Failing Backend B", nil
+	})
+
+	proxyURL := "http://" + httpServer.Addr + "/breakertest"
+	send := func() string {
+		resp, err := helpers.SendRequest("GET", proxyURL, nil)
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body)
+	}
+	circuitStates := func() []string {
+		resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/status", nil)
+		assert.NoError(t, err, "Failed to send GET request to /status")
+		defer resp.Body.Close()
+
+		var status proxy.StatusResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status), "Failed to parse status response")
+		states := make([]string, 0, len(status.Backends))
+		for _, backend := range status.Backends {
+			states = append(states, backend.CircuitState)
+		}
+		return states
+	}
+
+	assert.Equal(t, []string{"closed", "closed"}, circuitStates(), "Breakers should start closed")
+
+	// Two failures out of two requests to Backend B trip its breaker.
+	for i := 0; i < 4; i++ {
+		send()
+	}
+	assert.Equal(t, []string{"closed", "open"}, circuitStates(), "Backend B breaker should be open")
+
+	// While open, Backend B receives no traffic.
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "Response from Backend A", send(), "Expected open breaker to be skipped")
+	}
+
+	// Backend B recovers, and once the open duration passes a probe closes the breaker again.
+	backendB.SetDynamicResponse(nil)
+	time.Sleep(1100 * time.Millisecond)
+
+	seenB := false
+	for i := 0; i < 2; i++ {
+		if send() == "Response from Backend B" {
+			seenB = true
+		}
+	}
+	assert.True(t, seenB, "Expected a probe request to reach Backend B")
+	assert.Equal(t, []string{"closed", "closed"}, circuitStates(), "Backend B breaker should close after a successful probe")
+}
+
+func TestCircuitBreakerIgnoresStaleOutcomes(t *testing.T) {
+	// A single backend whose paths answer slowly or fail on demand.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-ok":
+			time.Sleep(1500 * time.Millisecond)
+		case "/slow-fail":
+			time.Sleep(1500 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{
+			RequestsPerMinute: 6000,
+			Burst:             100,
+		},
+		"circuitBreaker": models.CircuitBreakerConfig{
+			Enabled:         true,
+			ErrorRatio:      0.5,
+			MinimumRequests: 2,
+			Window:          time.Minute,
+			OpenDuration:    500 * time.Millisecond,
+			HalfOpenProbes:  1,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backend.URL}, configOverrides)
+	defer teardown()
+
+	status := func(path string) int {
+		resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+path, nil)
+		if !assert.NoError(t, err, "Failed to send GET request to proxy") {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	circuitState := func() string {
+		resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/status", nil)
+		assert.NoError(t, err, "Failed to send GET request to /status")
+		defer resp.Body.Close()
+
+		var status proxy.StatusResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status), "Failed to parse status response")
+		return status.Backends[0].CircuitState
+	}
+
+	// A request admitted while the breaker is closed is still running when it opens.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusOK, status("/slow-ok"), "Expected the slow request to succeed")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	status("/fail")
+	status("/fail")
+	assert.Equal(t, "open", circuitState(), "Expected two failures to open the breaker")
+
+	// Once the open duration passes a probe is let through, and nothing else.
+	time.Sleep(600 * time.Millisecond)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusInternalServerError, status("/slow-fail"), "Expected the probe to fail")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "half_open", circuitState(), "Expected the breaker to be half-open")
+	assert.Equal(t, http.StatusServiceUnavailable, status("/"), "Expected no request beyond the probe")
+
+	// The older request succeeding says nothing about the probe.
+	time.Sleep(900 * time.Millisecond)
+	assert.Equal(t, "half_open", circuitState(), "Expected the stale success not to close the breaker")
+
+	// The probe failing opens the breaker again.
+	wg.Wait()
+	assert.Equal(t, "open", circuitState(), "Expected the failed probe to reopen the breaker")
+}
+
+func TestCircuitBreakerRefusalPicksAnotherBackend(t *testing.T) {
+	// Backend A is fine, Backend B fails every request that reaches it.
+	backendA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backendA.Close()
+	backendB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backendB.Close()
+
+	configOverrides := map[string]interface{}{
+		// Power of two choices picks without a lock, so many requests race for B's single probe
+		"strategy": "p2c",
+		"ratelimit": models.RateLimitConfig{
+			RequestsPerMinute: 600000,
+			Burst:             10000,
+		},
+		"circuitBreaker": models.CircuitBreakerConfig{
+			Enabled:         true,
+			ErrorRatio:      0.5,
+			MinimumRequests: 2,
+			Window:          time.Minute,
+			OpenDuration:    100 * time.Millisecond,
+			HalfOpenProbes:  1,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backendA.URL, backendB.URL}, configOverrides)
+	defer teardown()
+
+	// Every round starts as B turns half-open, only one request may probe it
+	// and the rest must be sent to A rather than turned away.
+	statuses := map[int]int{}
+	for round := 0; round < 20; round++ {
+		time.Sleep(150 * time.Millisecond)
+
+		var (
+			mu sync.Mutex
+			wg sync.WaitGroup
+		)
+		start := make(chan struct{})
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/breakertest", nil)
+				if !assert.NoError(t, err, "Failed to send GET request to proxy") {
+					return
+				}
+				resp.Body.Close()
+				mu.Lock()
+				statuses[resp.StatusCode]++
+				mu.Unlock()
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	assert.Zero(t, statuses[http.StatusServiceUnavailable], "Expected no request to be turned away while Backend A was available")
+	assert.NotZero(t, statuses[http.StatusInternalServerError], "Expected Backend B to be probed")
+}
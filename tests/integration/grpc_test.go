@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestGRPCProxying(t *testing.T) {
+	// One backend over h2c in the default pool, one over TLS behind the "secure" route.
+	plain := helpers.NewGRPCBackend("plain", false)
+	defer plain.Close()
+
+	secure := helpers.NewGRPCBackend("secure", true)
+	defer secure.Close()
+
+	// Trust the self-signed certificate of the TLS backend.
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0o600), "Failed to write CA file")
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"upstream": models.UpstreamConfig{
+			HTTP2: true,
+			TLS:   models.UpstreamTLSConfig{CAFile: caFile},
+		},
+		"healthCheck": models.HealthCheckConfig{
+			Frequency:          50 * time.Millisecond,
+			Timeout:            time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+			GRPC:               true,
+		},
+		"backends": []models.Backend{{URL: plain.URL, Weight: 1}},
+		"upstreams": map[string]models.PoolConfig{
+			"secure": {Backends: []models.Backend{{URL: secure.URL, Weight: 1}}},
+		},
+		"routes": []models.RouteConfig{
+			{Name: "secure", Headers: []models.MatchCondition{{Name: "X-Pool", Exact: "secure"}}, Upstream: "secure"},
+		},
+	}
+
+	// Setup proxy server, both backends have to pass a gRPC health check to start.
+	httpServer, teardown := helpers.SetupProxy(t, nil, configOverrides)
+	defer teardown()
+
+	// gRPC clients need HTTP/2, so reach the proxy's handler over TLS.
+	front := httptest.NewUnstartedServer(httpServer.Handler)
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(front.URL, "https://"),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	assert.NoError(t, err, "Failed to create gRPC client")
+	defer conn.Close()
+
+	echo := func(ctx context.Context, method, value string) (string, metadata.MD, metadata.MD, error) {
+		var header, trailer metadata.MD
+		out := new(wrapperspb.StringValue)
+		err := conn.Invoke(ctx, "/test.Echo/"+method, wrapperspb.String(value), out, grpc.Header(&header), grpc.Trailer(&trailer))
+		return out.GetValue(), header, trailer, err
+	}
+
+	for _, pool := range []string{"plain", "secure"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-pool", pool)
+
+		// Unary calls carry headers and trailers through.
+		answer, header, trailer, err := echo(ctx, "Echo", "hello")
+		assert.NoError(t, err, "Expected the call to succeed over %s", pool)
+		assert.Equal(t, pool+": hello", answer, "Unexpected answer over %s", pool)
+		assert.Equal(t, []string{pool}, header.Get("x-backend"), "Expected the backend's header over %s", pool)
+		assert.Equal(t, []string{"none"}, trailer.Get("x-deadline"), "Expected the backend's trailer over %s", pool)
+
+		// The backend's status reaches the client with its message.
+		_, _, _, err = echo(ctx, "Fail", "")
+		assert.Equal(t, codes.NotFound, status.Code(err), "Expected the backend's status over %s", pool)
+		assert.Equal(t, "no such thing", status.Convert(err).Message(), "Expected the backend's message over %s", pool)
+
+		// Server streams arrive in full, followed by their trailers.
+		answers, trailer, err := helpers.GRPCCount(ctx, conn, 5)
+		assert.NoError(t, err, "Expected the stream to succeed over %s", pool)
+		assert.Equal(t, []string{"1", "2", "3", "4", "5"}, answers, "Expected every streamed answer over %s", pool)
+		assert.Equal(t, []string{"5"}, trailer.Get("x-count"), "Expected the stream's trailer over %s", pool)
+	}
+
+	// The caller's deadline is passed on to the backend, less the time already spent.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	_, _, trailer, err := echo(ctx, "Echo", "in time")
+	cancel()
+	assert.NoError(t, err, "Expected the call to succeed")
+	remaining, _ := strconv.Atoi(strings.Join(trailer.Get("x-deadline"), ""))
+	assert.InDelta(t, 2000, remaining, 200, "Expected the backend to see the caller's deadline")
+
+	// A deadline that passes is enforced by the proxy as well as the backend.
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	start := time.Now()
+	_, _, _, err = echo(ctx, "Slow", "")
+	cancel()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "Expected the deadline to be exceeded")
+	assert.Less(t, time.Since(start), time.Second, "Expected the call to end at its deadline")
+
+	// Failures of the proxy itself are gRPC statuses, not HTML error pages.
+	plain.Health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	time.Sleep(300 * time.Millisecond)
+	_, _, _, err = echo(context.Background(), "Echo", "anyone?")
+	assert.Equal(t, codes.Unavailable, status.Code(err), "Expected no backend to map to UNAVAILABLE")
+	assert.True(t, strings.HasPrefix(status.Convert(err).Message(), "proxy: "), "Expected the proxy's message, got %q", status.Convert(err).Message())
+
+	plain.Health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	time.Sleep(300 * time.Millisecond)
+	plain.Close()
+	_, _, _, err = echo(context.Background(), "Echo", "anyone?")
+	assert.Equal(t, codes.Unavailable, status.Code(err), "Expected a backend that is gone to map to UNAVAILABLE")
+}
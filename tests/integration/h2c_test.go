@@ -0,0 +1,82 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/pkg/utils"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func TestH2CListener(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	backend := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer backend.Close()
+	backend.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		return 200, "backend " + r.URL.Path, nil
+	})
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"h2c": models.H2CConfig{
+			Enabled:              true,
+			MaxConcurrentStreams: 50,
+			StreamWindowSize:     256 << 10,
+			ConnWindowSize:       4 << 20,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backend.Server.URL}, configOverrides)
+	defer teardown()
+
+	// Clients with prior knowledge start with the HTTP/2 preface right away,
+	// and can have many requests in flight on one connection.
+	client := &http.Client{Transport: utils.H2CTransport(&net.Dialer{})}
+	defer client.CloseIdleConnections()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://" + httpServer.Addr + "/prior")
+			if !assert.NoError(t, err, "Failed to send h2c request") {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, 2, resp.ProtoMajor, "Expected HTTP/2 with prior knowledge")
+			assert.Equal(t, "backend /prior", string(body), "Unexpected response body")
+		}()
+	}
+	wg.Wait()
+
+	// Clients can also upgrade an HTTP/1.1 request, which is answered over HTTP/2.
+	result, err := helpers.H2CUpgrade(httpServer.Addr, "/upgraded")
+	assert.NoError(t, err, "Failed to upgrade to h2c")
+	assert.Equal(t, http.StatusSwitchingProtocols, result.Upgrade.StatusCode, "Expected the upgrade to be accepted")
+	assert.Equal(t, http.StatusOK, result.Status, "Expected the upgraded request to be answered")
+	assert.Equal(t, "backend /upgraded", result.Body, "Unexpected response body")
+
+	// The configured stream limit and windows are announced to clients.
+	assert.Equal(t, uint32(50), result.Settings[http2.SettingMaxConcurrentStreams], "Expected the configured stream limit")
+	assert.Equal(t, uint32(256<<10), result.Settings[http2.SettingInitialWindowSize], "Expected the configured stream window")
+	assert.Equal(t, uint32(4<<20-65535), result.ConnWindowIncrement, "Expected the connection window grown to the configured size")
+
+	// HTTP/1.1 clients keep working on the same port.
+	resp, err := http.Get("http://" + httpServer.Addr + "/classic")
+	assert.NoError(t, err, "Failed to send HTTP/1.1 request")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor, "Expected HTTP/1.1")
+	assert.Equal(t, "backend /classic", string(body), "Unexpected response body")
+}
@@ -1,6 +1,7 @@
 package integration
 
 import (
+	"http-reverse-proxy/pkg/models"
 	"http-reverse-proxy/tests/helpers"
 	"io/ioutil"
 	"testing"
@@ -104,3 +105,67 @@ func TestHealthChecks(t *testing.T) {
 	assert.InDelta(t, expectedB, counter.recoveredB, float64(tolerance), "Recovered Backend B responses are outside the acceptable range")
 
 }
+
+func TestHealthCheckConfiguration(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends.
+	backendA := helpers.NewMockBackend(200, "Ready Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Ready Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"healthCheck": models.HealthCheckConfig{
+			Frequency:          300 * time.Millisecond,
+			Timeout:            time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 3,
+			Path:               "/ready",
+			ExpectedStatuses:   []string{"2xx"},
+			BodyContains:       "Ready",
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	// The startup probe uses the configured path.
+	requests := backendA.GetRequests()
+	if assert.NotEmpty(t, requests, "Expected a startup health check") {
+		assert.Equal(t, "/ready", requests[0].URL.Path, "Unexpected health check path")
+	}
+
+	proxyURL := "http://" + httpServer.Addr + "/healthconfigtest"
+	countBackendB := func(requestCount int) int {
+		count := 0
+		for i := 0; i < requestCount; i++ {
+			resp, err := helpers.SendRequest("GET", proxyURL, nil)
+			assert.NoError(t, err, "Failed to send GET request to proxy")
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NoError(t, err, "Failed to read response body")
+			if string(body) != "Ready Backend A" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Backend B still answers 200 but no longer matches body_contains.
+	backendB.SetStaticResponse(200, "Draining Backend B", nil)
+
+	// One failed probe is below the unhealthy threshold, so B stays in rotation.
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 1, countBackendB(2), "Backend B should still receive traffic after a single failure")
+
+	// After three consecutive failures B is taken out.
+	time.Sleep(800 * time.Millisecond)
+	assert.Equal(t, 0, countBackendB(4), "Backend B should be out of rotation")
+}
@@ -0,0 +1,137 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedging(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"hedging": models.HedgingConfig{
+			Enabled:         true,
+			Delay:           50 * time.Millisecond,
+			BudgetMinHedges: 5,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	// Backend A becomes slow once the proxy is up.
+	backendA.SetDelay(500 * time.Millisecond)
+
+	proxyURL := "http://" + httpServer.Addr + "/hedgetest"
+	send := func(method string) (string, time.Duration) {
+		start := time.Now()
+		req, err := http.NewRequest(method, proxyURL, nil)
+		assert.NoError(t, err, "Failed to create request")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body), time.Since(start)
+	}
+
+	// The GET starts on slow Backend A, gets hedged to B after the delay and B's answer wins.
+	body, elapsed := send("GET")
+	assert.Equal(t, "Response from Backend B", body, "Expected the hedged request to win")
+	assert.Less(t, elapsed, 400*time.Millisecond, "Expected hedging to cut the latency")
+
+	// POST is not idempotent and is never hedged, so it waits for Backend A.
+	body, elapsed = send("POST")
+	assert.Equal(t, "Response from Backend A", body, "Expected POST to stay on its backend")
+	assert.GreaterOrEqual(t, elapsed, 500*time.Millisecond, "Expected POST to wait for the slow backend")
+}
+
+func TestHedgeBudgetNotSpentWithoutHedge(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"healthCheck": models.HealthCheckConfig{
+			Frequency:          100 * time.Millisecond,
+			Timeout:            2 * time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+			Path:               "/health",
+		},
+		// A single hedge for the whole test
+		"hedging": models.HedgingConfig{
+			Enabled:         true,
+			Delay:           50 * time.Millisecond,
+			BudgetMinHedges: 1,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	// Backend A becomes slow and Backend B drops out of the pool.
+	backendA.SetDelay(300 * time.Millisecond)
+	backendB.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		return 503, "Down", nil
+	})
+	time.Sleep(400 * time.Millisecond)
+
+	proxyURL := "http://" + httpServer.Addr + "/hedgetest"
+	send := func() (string, time.Duration) {
+		start := time.Now()
+		resp, err := http.Get(proxyURL)
+		if !assert.NoError(t, err, "Failed to send request to proxy") {
+			return "", 0
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body), time.Since(start)
+	}
+
+	// With nowhere to hedge to, slow requests wait for Backend A without spending the budget.
+	for i := 0; i < 2; i++ {
+		body, elapsed := send()
+		assert.Equal(t, "Response from Backend A", body, "Expected the only backend to answer")
+		assert.GreaterOrEqual(t, elapsed, 300*time.Millisecond, "Expected to wait for the slow backend")
+	}
+
+	// Once Backend B is back the request that starts on Backend A still gets its hedge.
+	backendB.SetDynamicResponse(nil)
+	time.Sleep(400 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		body, elapsed := send()
+		assert.Equal(t, "Response from Backend B", body, "Expected Backend B to answer first")
+		assert.Less(t, elapsed, 250*time.Millisecond, "Expected the unspent budget to pay for the hedge")
+	}
+}
@@ -0,0 +1,93 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP3Listener(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	backend := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer backend.Close()
+	backend.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		return 200, "backend " + r.URL.Path, nil
+	})
+
+	certFile, keyFile, roots, err := helpers.WriteTestCertificate(t.TempDir())
+	assert.NoError(t, err, "Failed to write test certificate")
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"serverTLS": models.ServerTLSConfig{CertFile: certFile, KeyFile: keyFile},
+		"http3": models.HTTP3Config{
+			Enabled:     true,
+			IdleTimeout: 6 * time.Second,
+			MaxStreams:  5,
+		},
+	}
+
+	// Setup proxy server, listening on TCP and UDP port 8080.
+	_, teardown := helpers.SetupProxy(t, []string{backend.Server.URL}, configOverrides)
+	defer teardown()
+
+	// Responses over TCP advertise the HTTP/3 listener.
+	tcpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	defer tcpClient.CloseIdleConnections()
+	resp, err := tcpClient.Get("https://localhost:8080/over-tcp")
+	assert.NoError(t, err, "Failed to send request over TCP")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "backend /over-tcp", string(body), "Unexpected response body over TCP")
+	assert.Equal(t, `h3=":8080"; ma=2592000`, resp.Header.Get("Alt-Svc"), "Expected the HTTP/3 listener to be advertised")
+
+	// The same handlers answer over QUIC with the same certificate.
+	h3Transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer h3Transport.Close()
+	h3Client := &http.Client{Transport: h3Transport}
+	resp, err = h3Client.Get("https://localhost:8080/over-quic")
+	assert.NoError(t, err, "Failed to send request over HTTP/3")
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 3, resp.ProtoMajor, "Expected HTTP/3")
+	assert.Equal(t, "backend /over-quic", string(body), "Unexpected response body over HTTP/3")
+	assert.Empty(t, resp.Header.Get("Alt-Svc"), "Expected no Alt-Svc over HTTP/3 itself")
+
+	// The stream limit applies per connection.
+	conn, err := quic.DialAddr(context.Background(), "localhost:8080",
+		&tls.Config{RootCAs: roots, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{MaxIdleTimeout: time.Minute})
+	assert.NoError(t, err, "Failed to open QUIC connection")
+	for i := 0; i < 5; i++ {
+		_, err := conn.OpenStream()
+		assert.NoError(t, err, "Expected stream %d within the limit", i+1)
+	}
+	_, err = conn.OpenStream()
+	var limitErr *quic.StreamLimitReachedError
+	assert.True(t, errors.As(err, &limitErr), "Expected the stream limit to be reached, got %v", err)
+
+	// Quiet connections are closed after the proxy's idle timeout, even if the
+	// client would wait longer. QUIC clients do not accept less than 5s.
+	start := time.Now()
+	select {
+	case <-conn.Context().Done():
+		assert.InDelta(t, 6000, time.Since(start).Milliseconds(), 500, "Expected the connection closed after the idle timeout")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+	// Give the proxy's side of the connection the moment it lags behind, so shutting down need not wait for it.
+	time.Sleep(200 * time.Millisecond)
+}
@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"testing"
+	"time"
+)
+
+// benchmarkSkewedLatency proxies requests to one fast and one slow backend using the given
+// strategy and reports the share of requests that ended up on the slow backend.
+func benchmarkSkewedLatency(b *testing.B, strategy string) {
+	logger, err := helpers.NewTestLogger()
+	if err != nil {
+		b.Fatalf("Failed to create test logger: %v", err)
+	}
+
+	fast := helpers.NewMockBackend(200, "fast", nil, logger)
+	defer fast.Close()
+
+	slow := helpers.NewMockBackend(200, "slow", nil, logger)
+	defer slow.Close()
+
+	configOverrides := map[string]interface{}{
+		"strategy": strategy,
+		"ratelimit": models.RateLimitConfig{
+			RequestsPerMinute: 1_000_000_000,
+			Burst:             1_000_000,
+		},
+	}
+
+	httpServer, teardown := helpers.SetupProxy(b, []string{fast.Server.URL, slow.Server.URL}, configOverrides)
+	defer teardown()
+
+	// Skew latency once startup health checks are done.
+	fast.SetDelay(1 * time.Millisecond)
+	slow.SetDelay(20 * time.Millisecond)
+
+	proxyURL := "http://" + httpServer.Addr + "/benchmark"
+	fastBefore, slowBefore := fast.RequestCount(), slow.RequestCount()
+
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := helpers.SendRequest("GET", proxyURL, nil)
+			if err != nil {
+				b.Errorf("Failed to send GET request to proxy: %v", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+	b.StopTimer()
+
+	fastHits := fast.RequestCount() - fastBefore
+	slowHits := slow.RequestCount() - slowBefore
+	if total := fastHits + slowHits; total > 0 {
+		b.ReportMetric(float64(slowHits)/float64(total), "slow-share")
+	}
+}
+
+func BenchmarkSkewedLatencyRoundRobin(b *testing.B) {
+	benchmarkSkewedLatency(b, "round_robin")
+}
+
+func BenchmarkSkewedLatencyP2C(b *testing.B) {
+	benchmarkSkewedLatency(b, "p2c")
+}
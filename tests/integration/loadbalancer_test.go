@@ -1,9 +1,11 @@
 package integration
 
 import (
+	"http-reverse-proxy/pkg/models"
 	"http-reverse-proxy/tests/helpers"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -52,3 +54,237 @@ func TestLoadBalancingRoundRobin(t *testing.T) {
 	assert.Len(t, backendA.GetRequests(), 3, "Backend A should receive 2 requests")
 	assert.Len(t, backendB.GetRequests(), 3, "Backend B should receive 2 requests")
 }
+
+func TestLoadBalancingWeightedRoundRobin(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends with a 3:1 weight ratio.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	configOverrides := map[string]interface{}{
+		"strategy": "weighted_round_robin",
+		"backends": []models.Backend{
+			{URL: backendA.Server.URL, Weight: 3},
+			{URL: backendB.Server.URL, Weight: 1},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, nil, configOverrides)
+	defer teardown()
+
+	// Smooth weighted round robin interleaves the lighter backend instead of bursting.
+	expectedResponses := []string{
+		"Response from Backend A",
+		"Response from Backend A",
+		"Response from Backend B",
+		"Response from Backend A",
+		"Response from Backend A",
+		"Response from Backend A",
+		"Response from Backend B",
+		"Response from Backend A",
+	}
+
+	for i, expected := range expectedResponses {
+		proxyURL := "http://" + httpServer.Addr + "/weightedtest"
+		resp, err := helpers.SendRequest("GET", proxyURL, nil)
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "Failed to read response body")
+		assert.Equal(t, expected, string(body), "Unexpected response body for request %d", i)
+	}
+
+	// Each backend also received the initial health check.
+	assert.Len(t, backendA.GetRequests(), 7, "Backend A should receive 6 requests")
+	assert.Len(t, backendB.GetRequests(), 3, "Backend B should receive 2 requests")
+}
+
+func TestLoadBalancingLeastConnections(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends, A will be made slow once the proxy is up.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, map[string]interface{}{
+		"strategy": "least_connections",
+	})
+	defer teardown()
+
+	backendA.SetDelay(1 * time.Second)
+	proxyURL := "http://" + httpServer.Addr + "/leastconntest"
+
+	// The first request ties on zero in-flight requests and lands on Backend A, where it stays busy.
+	slowDone := make(chan string, 1)
+	go func() {
+		resp, err := helpers.SendRequest("GET", proxyURL, nil)
+		if err != nil {
+			slowDone <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		slowDone <- string(body)
+	}()
+
+	// Give the slow request time to reach Backend A.
+	time.Sleep(200 * time.Millisecond)
+
+	// While A is busy every request should go to B, plain round robin would alternate.
+	for i := 0; i < 3; i++ {
+		resp, err := helpers.SendRequest("GET", proxyURL, nil)
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "Failed to read response body")
+		assert.Equal(t, "Response from Backend B", string(body), "Expected the idle backend to be picked")
+	}
+
+	assert.Equal(t, "Response from Backend A", <-slowDone, "Slow request should be served by Backend A")
+}
+
+func TestLoadBalancingConsistentHash(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup three mock backends.
+	responses := []string{"Response from Backend A", "Response from Backend B", "Response from Backend C"}
+	backends := make([]*helpers.MockBackend, 0, len(responses))
+	backendURLs := make([]string, 0, len(responses))
+	for _, response := range responses {
+		backend := helpers.NewMockBackend(200, response, nil, logger)
+		defer backend.Close()
+		backends = append(backends, backend)
+		backendURLs = append(backendURLs, backend.Server.URL)
+	}
+
+	configOverrides := map[string]interface{}{
+		"healthCheckFreq": 500 * time.Millisecond,
+		"ratelimit": models.RateLimitConfig{
+			RequestsPerMinute: 6000,
+			Burst:             100,
+		},
+		"strategy": "consistent_hash",
+		"hash": models.HashConfig{
+			Key:  "header",
+			Name: "X-User-ID",
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	proxyURL := "http://" + httpServer.Addr + "/hashtest"
+	backendFor := func(user string) string {
+		resp, err := helpers.SendRequest("GET", proxyURL, map[string]string{"X-User-ID": user})
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body)
+	}
+
+	// The same key always lands on the same backend.
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy"}
+	assignments := make(map[string]string, len(users))
+	for _, user := range users {
+		assignments[user] = backendFor(user)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, assignments[user], backendFor(user), "Expected %s to stick to one backend", user)
+		}
+	}
+
+	// Take Backend A out of rotation and wait for the health checker to notice.
+	backends[0].SetStaticResponse(500, "Unhealthy Backend A", nil)
+	time.Sleep(1500 * time.Millisecond)
+
+	// Only the keys that lived on Backend A move, everyone else keeps their backend.
+	for _, user := range users {
+		current := backendFor(user)
+		if assignments[user] == responses[0] {
+			assert.NotEqual(t, responses[0], current, "Expected %s to move off the unhealthy backend", user)
+		} else {
+			assert.Equal(t, assignments[user], current, "Expected %s to keep its backend", user)
+		}
+	}
+}
+
+func TestLoadBalancingP2CRecovers(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends, A will be slow for a single request.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, map[string]interface{}{
+		"strategy":  "p2c",
+		"ewmaDecay": 200 * time.Millisecond,
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+	})
+	defer teardown()
+
+	proxyURL := "http://" + httpServer.Addr + "/p2ctest"
+	send := func() string {
+		resp, err := helpers.SendRequest("GET", proxyURL, nil)
+		if !assert.NoError(t, err, "Failed to send GET request to proxy") {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body)
+	}
+
+	// Backend A answers one request slowly, a backend without samples is tried
+	// first so it takes at most two requests to get there.
+	backendA.SetDelay(500 * time.Millisecond)
+	penalized := false
+	for i := 0; i < 2 && !penalized; i++ {
+		penalized = send() == "Response from Backend A"
+	}
+	assert.True(t, penalized, "Expected Backend A to serve a slow request")
+	backendA.SetDelay(0)
+
+	// Right afterwards the slow sample keeps Backend A out of the way.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "Response from Backend B", send(), "Expected the fast backend while A's latency is fresh")
+	}
+
+	// Without new samples A's latency fades, so it is picked again.
+	time.Sleep(2 * time.Second)
+	hitsA := 0
+	for i := 0; i < 10; i++ {
+		if send() == "Response from Backend A" {
+			hitsA++
+		}
+	}
+	assert.Greater(t, hitsA, 0, "Expected the recovered backend to get traffic again")
+}
@@ -0,0 +1,179 @@
+package integration
+
+import (
+	"encoding/json"
+	"http-reverse-proxy/internal/loadbalancer"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shadowCopy is what the shadow backend saw of a mirrored request
+type shadowCopy struct {
+	method string
+	path   string
+	body   string
+	marker string
+}
+
+func TestTrafficMirroring(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	primary := helpers.NewMockBackend(200, "primary", nil, logger)
+	defer primary.Close()
+
+	// The shadow is slow and failing, neither may show up for the client.
+	shadow := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer shadow.Close()
+	shadow.SetDelay(300 * time.Millisecond)
+	copies := make(chan shadowCopy, 1000)
+	var received atomic.Int64
+	shadow.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		if r.URL.Path == "/health" {
+			return 200, "OK", nil
+		}
+		received.Add(1)
+		body, _ := ioutil.ReadAll(r.Body)
+		copies <- shadowCopy{r.Method, r.URL.Path, string(body), r.Header.Get("X-Shadow")}
+		return 500, "shadow", nil
+	})
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 600000, Burst: 10000},
+		// The shadow's failures must not count against it, live traffic may use the same pool
+		"circuitBreaker": models.CircuitBreakerConfig{
+			Enabled:         true,
+			MinimumRequests: 2,
+			Window:          time.Minute,
+			OpenDuration:    time.Minute,
+		},
+		"outlierDetection": models.OutlierDetectionConfig{
+			Enabled:             true,
+			ConsecutiveFailures: 2,
+			Interval:            time.Minute,
+			BaseEjectionTime:    time.Minute,
+			MaxEjectionPercent:  100,
+		},
+		"upstreams": map[string]models.PoolConfig{
+			"shadow": {Backends: []models.Backend{{URL: shadow.Server.URL}}},
+		},
+		"routes": []models.RouteConfig{
+			{
+				Name:   "orders",
+				Prefix: "/orders",
+				Mirror: models.MirrorConfig{Upstream: "shadow", Percentage: 100, MaxBodyBytes: 1024, Header: "X-Shadow"},
+			},
+			{
+				Name:   "search",
+				Prefix: "/search",
+				Mirror: models.MirrorConfig{Upstream: "shadow", Percentage: 25, MaxInFlight: 1000},
+			},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{primary.Server.URL}, configOverrides)
+	defer teardown()
+
+	send := func(method, path string, body io.Reader) (int, string, time.Duration) {
+		req, err := http.NewRequest(method, "http://"+httpServer.Addr+path, body)
+		assert.NoError(t, err, "Failed to create request")
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return resp.StatusCode, string(respBody), time.Since(start)
+	}
+
+	// The client gets the primary response without waiting for the shadow.
+	status, body, elapsed := send("POST", "/orders/new", strings.NewReader(`{"item": 42}`))
+	assert.Equal(t, http.StatusOK, status, "Expected the primary status")
+	assert.Equal(t, "primary", body, "Expected the primary response")
+	assert.Less(t, elapsed, 200*time.Millisecond, "Expected the shadow not to slow the client down")
+
+	// The shadow gets the same request and body, marked as a shadow copy.
+	select {
+	case c := <-copies:
+		assert.Equal(t, shadowCopy{"POST", "/orders/new", `{"item": 42}`, "true"}, c, "Unexpected shadow request")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+
+	// Bodies over the limit are only sent to the primary.
+	status, body, _ = send("POST", "/orders/bulk", strings.NewReader(strings.Repeat("x", 4096)))
+	assert.Equal(t, http.StatusOK, status, "Expected large bodies to still be proxied")
+	assert.Equal(t, "primary", body, "Expected the primary response")
+
+	// Also when they are sent chunked, without a length up front.
+	status, body, _ = send("POST", "/orders/chunked", io.MultiReader(strings.NewReader(strings.Repeat("x", 4096))))
+	assert.Equal(t, http.StatusOK, status, "Expected chunked bodies to still be proxied")
+	assert.Equal(t, "primary", body, "Expected the primary response")
+
+	// Only a sample of the sampled route is mirrored.
+	for i := 0; i < 400; i++ {
+		send("GET", "/search?q=go", nil)
+	}
+	// Routes without a mirror are never copied.
+	send("GET", "/other", nil)
+
+	// Wait for the shadow requests to finish, polling slower than the shadow
+	// answers so copies still on their way are not missed.
+	var (
+		mirrors  map[string]proxy.MirrorStatus
+		shadowed []loadbalancer.BackendStatus
+	)
+	previous := -1
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + httpServer.Addr + "/status")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		var status proxy.StatusResponse
+		if json.NewDecoder(resp.Body).Decode(&status) != nil {
+			return false
+		}
+		shadowed = status.Upstreams["shadow"]
+		mirrors = map[string]proxy.MirrorStatus{}
+		for _, mirror := range status.Mirrors {
+			mirrors[mirror.Route] = mirror
+		}
+		completed := mirrors["orders"].Shadow.Requests + mirrors["search"].Shadow.Requests
+		settled := completed == previous && int64(completed) == received.Load()
+		previous = completed
+		return settled
+	}, 10*time.Second, 500*time.Millisecond, "Expected every shadow request to complete")
+
+	orders := mirrors["orders"]
+	assert.Equal(t, int64(2), orders.Skipped, "Expected both large bodies to be skipped")
+	assert.Equal(t, 3, orders.Primary.Requests, "Expected every primary request to be recorded")
+	assert.Equal(t, map[int]int{200: 3}, orders.Primary.Statuses, "Unexpected primary statuses")
+	assert.Equal(t, 1, orders.Shadow.Requests, "Expected one shadow request")
+	assert.Equal(t, map[int]int{500: 1}, orders.Shadow.Statuses, "Expected the shadow status to be recorded separately")
+
+	search := mirrors["search"]
+	assert.Equal(t, 400, search.Primary.Requests, "Expected every primary request to be recorded")
+	assert.InDelta(t, 100, search.Shadow.Requests, 40, "Expected about a quarter of the requests to be mirrored")
+	assert.Equal(t, map[int]int{500: search.Shadow.Requests}, search.Shadow.Statuses, "Unexpected shadow statuses")
+	assert.Greater(t, search.Shadow.P50, search.Primary.P50, "Expected the slower shadow latency to be recorded")
+
+	// Every shadow answer was a 500, yet the shadow pool is as it started.
+	if assert.Len(t, shadowed, 1, "Expected the shadow pool in the status") {
+		assert.Equal(t, "closed", shadowed[0].CircuitState, "Expected shadow failures not to open the breaker")
+		assert.False(t, shadowed[0].Ejected, "Expected shadow failures not to eject the backend")
+		assert.Equal(t, int64(0), shadowed[0].InFlight, "Expected every shadow request to be released")
+	}
+}
@@ -0,0 +1,182 @@
+package integration
+
+import (
+	"encoding/json"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"outlierDetection": models.OutlierDetectionConfig{
+			Enabled:             true,
+			ConsecutiveFailures: 2,
+			BaseEjectionTime:    time.Second,
+			MaxEjectionPercent:  50,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	// Backend B keeps passing its health check but fails real traffic.
+	backendB.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		if r.URL.Path == "/health" {
+			return 200, "OK", nil
+		}
+		return 503, "Failing Backend B", nil
+	})
+
+	proxyURL := "http://" + httpServer.Addr + "/outliertest"
+	send := func() string {
+		resp, err := helpers.SendRequest("GET", proxyURL, nil)
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body)
+	}
+
+	// Round robin alternates until Backend B fails twice in a row.
+	for i := 0; i < 4; i++ {
+		send()
+	}
+
+	// Backend B is now ejected, so only Backend A serves traffic.
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "Response from Backend A", send(), "Expected ejected backend to be skipped")
+	}
+
+	// The status endpoint reports the ejection.
+	resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/status", nil)
+	assert.NoError(t, err, "Failed to send GET request to /status")
+	var status proxy.StatusResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status), "Failed to parse status response")
+	resp.Body.Close()
+	if assert.Len(t, status.Backends, 2, "Expected two backends in status") {
+		assert.False(t, status.Backends[0].Ejected, "Backend A should not be ejected")
+		assert.True(t, status.Backends[1].Ejected, "Backend B should be ejected")
+	}
+
+	// The ejection expires and Backend B is given another chance.
+	time.Sleep(1200 * time.Millisecond)
+	seenB := false
+	for i := 0; i < 2; i++ {
+		if send() == "Failing Backend B" {
+			seenB = true
+		}
+	}
+	assert.True(t, seenB, "Expected Backend B to return after its ejection expired")
+}
+
+func TestOutlierDetectionConcurrentEjections(t *testing.T) {
+	const numBackends = 8
+
+	// Every backend holds its request until all of them have one, then they
+	// all fail at once.
+	var (
+		mu      sync.Mutex
+		arrived int
+		release chan struct{}
+	)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		mu.Lock()
+		arrived++
+		gate := release
+		if arrived == numBackends {
+			close(gate)
+		}
+		mu.Unlock()
+		<-gate
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	backendURLs := make([]string, numBackends)
+	for i := range backendURLs {
+		backend := httptest.NewServer(handler)
+		defer backend.Close()
+		backendURLs[i] = backend.URL
+	}
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 60000, Burst: 1000},
+		// A single failure is enough, but only one backend may be out at a time
+		"outlierDetection": models.OutlierDetectionConfig{
+			Enabled:             true,
+			ConsecutiveFailures: 1,
+			BaseEjectionTime:    100 * time.Millisecond,
+			MaxEjectionTime:     100 * time.Millisecond,
+			MaxEjectionPercent:  10,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	for round := 0; round < 20; round++ {
+		mu.Lock()
+		arrived = 0
+		release = make(chan struct{})
+		mu.Unlock()
+
+		var wg sync.WaitGroup
+		for i := 0; i < numBackends; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := http.Get("http://" + httpServer.Addr + "/outliertest")
+				if assert.NoError(t, err, "Failed to send GET request to proxy") {
+					resp.Body.Close()
+				}
+			}()
+		}
+		wg.Wait()
+
+		resp, err := http.Get("http://" + httpServer.Addr + "/status")
+		if !assert.NoError(t, err, "Failed to send GET request to /status") {
+			return
+		}
+		var status proxy.StatusResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status), "Failed to parse status response")
+		resp.Body.Close()
+
+		ejected := 0
+		for _, backend := range status.Backends {
+			if backend.Ejected {
+				ejected++
+			}
+		}
+		if !assert.LessOrEqual(t, ejected, 1, "Expected at most one backend ejected in round %d", round) {
+			return
+		}
+
+		// Let the ejection run out before the next round
+		time.Sleep(150 * time.Millisecond)
+	}
+}
@@ -0,0 +1,155 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetries(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends, A fails real traffic while B echoes request bodies.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"retry": models.RetryConfig{
+			Attempts:     1,
+			RetryOn:      []int{503},
+			MaxBodyBytes: 1024,
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	backendA.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		if r.URL.Path == "/health" {
+			return 200, "OK", nil
+		}
+		return 503, "Unavailable Backend A", nil
+	})
+	backendB.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		body, _ := ioutil.ReadAll(r.Body)
+		return 200, "Response from Backend B: " + string(body), nil
+	})
+	backendA.GetRequests()
+	backendB.GetRequests()
+
+	proxyURL := "http://" + httpServer.Addr + "/retrytest"
+	send := func(method, body string) (int, string) {
+		req, err := http.NewRequest(method, proxyURL, strings.NewReader(body))
+		assert.NoError(t, err, "Failed to create request")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return resp.StatusCode, string(respBody)
+	}
+
+	// A PUT that fails on Backend A is retried on Backend B, body included.
+	status, body := send("PUT", "payload")
+	assert.Equal(t, 200, status, "Expected the retry to succeed")
+	assert.Equal(t, "Response from Backend B: payload", body, "Expected the body to be replayed on Backend B")
+	assert.Len(t, backendA.GetRequests(), 1, "Backend A should have been tried once")
+	assert.Len(t, backendB.GetRequests(), 1, "Backend B should have served the retry")
+
+	// POST is not idempotent, so the failure is returned to the client as is.
+	status, body = send("POST", "payload")
+	assert.Equal(t, 503, status, "Expected POST not to be retried")
+	assert.Equal(t, "Unavailable Backend A", body, "Unexpected response body")
+	assert.Len(t, backendB.GetRequests(), 0, "Backend B should not see the POST")
+
+	// Let round robin move past Backend B so the next request starts on A again.
+	send("GET", "")
+	backendB.GetRequests()
+
+	// Bodies over max_body_bytes are streamed and cannot be replayed.
+	large := strings.Repeat("x", 2048)
+	status, _ = send("PUT", large)
+	assert.Equal(t, 503, status, "Expected oversized body not to be retried")
+	assert.Len(t, backendB.GetRequests(), 0, "Backend B should not see the oversized request")
+}
+
+func TestRetriesOnMirroredRoute(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Both backends fail, so every retry shows up as a second request.
+	failing := func(r *http.Request) (int, string, map[string]string) {
+		if r.URL.Path == "/health" {
+			return 200, "OK", nil
+		}
+		return 503, "Unavailable", nil
+	}
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+	backendA.SetDynamicResponse(failing)
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+	backendB.SetDynamicResponse(failing)
+
+	shadow := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer shadow.Close()
+
+	configOverrides := map[string]interface{}{
+		"retry": models.RetryConfig{
+			Attempts:     1,
+			RetryOn:      []int{503},
+			MaxBodyBytes: 16,
+		},
+		"upstreams": map[string]models.PoolConfig{
+			"shadow": {Backends: []models.Backend{{URL: shadow.Server.URL}}},
+		},
+		// The mirror buffers more than the retry policy allows
+		"routes": []models.RouteConfig{
+			{
+				Name:   "orders",
+				Prefix: "/orders",
+				Mirror: models.MirrorConfig{Upstream: "shadow", Percentage: 100, MaxBodyBytes: 1024},
+			},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backendA.Server.URL, backendB.Server.URL}, configOverrides)
+	defer teardown()
+
+	send := func(body string) int {
+		req, err := http.NewRequest("PUT", "http://"+httpServer.Addr+"/orders/1", strings.NewReader(body))
+		assert.NoError(t, err, "Failed to create request")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	attempts := func() int {
+		return len(backendA.GetRequests()) + len(backendB.GetRequests())
+	}
+	attempts()
+
+	// A body within the retry limit is retried as usual.
+	assert.Equal(t, 503, send("small"), "Expected the last failure to be returned")
+	assert.Equal(t, 2, attempts(), "Expected the small body to be retried")
+
+	// A body only the mirror may buffer is not replayed on another backend.
+	assert.Equal(t, 503, send(strings.Repeat("x", 512)), "Expected the failure to be returned")
+	assert.Equal(t, 1, attempts(), "Expected the body over the retry limit not to be retried")
+}
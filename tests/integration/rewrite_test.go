@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRewriting(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// The backend echoes the request target exactly as it arrived.
+	backend := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer backend.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"routes": []models.RouteConfig{
+			{
+				Prefix:  "/svc/files",
+				Rewrite: models.RewriteConfig{StripPrefix: "/svc/files"},
+			},
+			{
+				Prefix: "/svc/users",
+				Rewrite: models.RewriteConfig{
+					ReplacePrefix: models.PrefixRewrite{From: "/svc/users", To: "/api/v1/users"},
+					SetQuery:      []models.QueryParam{{Name: "source", Value: "proxy"}},
+					AddQuery:      []models.QueryParam{{Name: "tag", Value: "a"}},
+				},
+			},
+			{
+				Prefix: "/svc/reports",
+				Rewrite: models.RewriteConfig{
+					Regex: models.RegexRewrite{Pattern: `^/svc/reports/([^/]+)/(.*)$`, Replacement: "/$1/reports/$2"},
+				},
+			},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backend.Server.URL}, configOverrides)
+	defer teardown()
+
+	backend.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		return 200, r.RequestURI, nil
+	})
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"strip prefix", "/svc/files/docs?x=1", "/docs?x=1"},
+		{"strip whole path", "/svc/files", "/"},
+		{"strip keeps encoded slash", "/svc/files/a%2Fb/c", "/a%2Fb/c"},
+		{"strip matches whole segments", "/svc/filesystem", "/svc/filesystem"},
+		{"replace prefix and query", "/svc/users/42?source=client&tag=b", "/api/v1/users/42?source=proxy&tag=b&tag=a"},
+		{"replace keeps encoded slash", "/svc/users/a%2Fb", "/api/v1/users/a%2Fb?source=proxy&tag=a"},
+		{"regex rewrite", "/svc/reports/2024/q1", "/2024/reports/q1"},
+		{"regex keeps encoded slash", "/svc/reports/2024/q1%2Fq2", "/2024/reports/q1%2Fq2"},
+		{"no rewrite keeps encoded slash", "/plain/a%2Fb", "/plain/a%2Fb"},
+		{"no rewrite keeps query order", "/plain?b=2&a=1", "/plain?b=2&a=1"},
+	}
+
+	for _, tc := range testCases {
+		resp, err := http.Get("http://" + httpServer.Addr + tc.path)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "Failed to read response body")
+		assert.Equal(t, tc.expected, string(body), "Unexpected backend request target for %s", tc.name)
+	}
+}
@@ -0,0 +1,121 @@
+package integration
+
+import (
+	"encoding/json"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCanaryRollout(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	stable := helpers.NewMockBackend(200, "stable", nil, logger)
+	defer stable.Close()
+
+	healthy := helpers.NewMockBackend(200, "healthy canary", nil, logger)
+	defer healthy.Close()
+
+	// The broken canary passes its health checks but fails real requests.
+	broken := helpers.NewMockBackend(200, "OK", nil, logger)
+	defer broken.Close()
+	broken.SetDynamicResponse(func(r *http.Request) (int, string, map[string]string) {
+		if r.URL.Path == "/health" {
+			return 200, "OK", nil
+		}
+		return 500, "broken canary", nil
+	})
+
+	rollout := models.RolloutConfig{
+		Enabled:         true,
+		Steps:           []float64{10, 50, 100},
+		Interval:        300 * time.Millisecond,
+		CheckInterval:   50 * time.Millisecond,
+		MinimumRequests: 5,
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 600000, Burst: 10000},
+		"logger":    zap.New(core),
+		"upstreams": map[string]models.PoolConfig{
+			"healthy": {Backends: []models.Backend{{URL: healthy.Server.URL}}},
+			"broken":  {Backends: []models.Backend{{URL: broken.Server.URL}}},
+		},
+		"routes": []models.RouteConfig{
+			{Name: "good", Prefix: "/good", Split: models.SplitConfig{Canary: "healthy", Rollout: rollout}},
+			{Name: "bad", Prefix: "/bad", Split: models.SplitConfig{Canary: "broken", Rollout: rollout}},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{stable.Server.URL}, configOverrides)
+	defer teardown()
+
+	splits := func() map[string]proxy.SplitStatus {
+		resp, err := http.Get("http://" + httpServer.Addr + "/status")
+		assert.NoError(t, err, "Failed to get status")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read status body")
+		var status proxy.StatusResponse
+		assert.NoError(t, json.Unmarshal(body, &status), "Failed to decode status response")
+		byRoute := map[string]proxy.SplitStatus{}
+		for _, split := range status.Splits {
+			byRoute[split.Route] = split
+		}
+		return byRoute
+	}
+
+	// Both rollouts start on their first step.
+	initial := splits()
+	assert.Equal(t, 10.0, initial["good"].Weight, "Expected the first step weight")
+	assert.Equal(t, proxy.RolloutProgressing, initial["good"].Rollout.State, "Expected the rollout to be progressing")
+
+	// Keep traffic flowing until both rollouts have finished.
+	done := func(s map[string]proxy.SplitStatus) bool {
+		return s["good"].Rollout.State != proxy.RolloutProgressing && s["bad"].Rollout.State != proxy.RolloutProgressing
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	var final map[string]proxy.SplitStatus
+	for time.Now().Before(deadline) {
+		for _, path := range []string{"/good/items", "/bad/items"} {
+			resp, err := http.Get("http://" + httpServer.Addr + path)
+			assert.NoError(t, err, "Failed to send request to proxy")
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if final = splits(); done(final) {
+			break
+		}
+	}
+
+	// The healthy canary is promoted all the way, the broken one is rolled back.
+	assert.Equal(t, proxy.RolloutCompleted, final["good"].Rollout.State, "Expected the healthy rollout to complete")
+	assert.Equal(t, 100.0, final["good"].Weight, "Expected the healthy canary to take all traffic")
+	assert.Equal(t, 2, final["good"].Rollout.Step, "Expected the healthy rollout on its last step")
+
+	assert.Equal(t, proxy.RolloutRolledBack, final["bad"].Rollout.State, "Expected the broken rollout to roll back")
+	assert.Equal(t, 0.0, final["bad"].Weight, "Expected the broken canary to get no traffic")
+	assert.NotEmpty(t, final["bad"].Rollout.Reason, "Expected a reason for the rollback")
+	assert.Equal(t, 1, logs.FilterMessage("Canary rollout rolled back").Len(), "Expected the rollback to be logged")
+
+	// After the rollback every request is served by the stable pool.
+	for i := 0; i < 20; i++ {
+		resp, err := http.Get("http://" + httpServer.Addr + "/bad/items")
+		assert.NoError(t, err, "Failed to send request to proxy")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "stable", string(body), "Expected stable responses after the rollback")
+	}
+}
@@ -0,0 +1,199 @@
+package integration
+
+import (
+	"encoding/json"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPathRouting(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// The monolith serves the default pool, the carved out services get pools of their own.
+	monolith := helpers.NewMockBackend(200, "monolith", nil, logger)
+	defer monolith.Close()
+
+	apiV2 := helpers.NewMockBackend(200, "api-v2", nil, logger)
+	defer apiV2.Close()
+
+	users := helpers.NewMockBackend(200, "users", nil, logger)
+	defer users.Close()
+
+	images := helpers.NewMockBackend(200, "images", nil, logger)
+	defer images.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"upstreams": map[string]models.PoolConfig{
+			"api_v2": {
+				Backends:      []models.Backend{{URL: apiV2.Server.URL}},
+				LoadBalancing: models.LoadBalancingConfig{Strategy: "least_connections"},
+			},
+			"users": {Backends: []models.Backend{{URL: users.Server.URL}}},
+			"images": {
+				Backends:    []models.Backend{{URL: images.Server.URL}},
+				HealthCheck: models.HealthCheckConfig{Path: "/health", Frequency: time.Second},
+			},
+		},
+		"routes": []models.RouteConfig{
+			{Name: "api-v2", Prefix: "/api/v2", Upstream: "api_v2"},
+			{Name: "users", Prefix: "/api/v2/users", Upstream: "users"},
+			{Name: "legacy-users", Path: "/api/v2/users/legacy", Upstream: "default"},
+			{Name: "images", Regex: `\.(png|jpg)$`, Upstream: "images"},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{monolith.Server.URL}, configOverrides)
+	defer teardown()
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/v2", "api-v2"},
+		{"/api/v2/orders/1", "api-v2"},
+		{"/api/v2/users", "users"},
+		{"/api/v2/users/42", "users"},
+		{"/api/v2/users/legacy", "monolith"},
+		{"/api/v2beta/orders", "monolith"},
+		{"/static/logo.png", "images"},
+		{"/api/v2/avatar.png", "api-v2"},
+		{"/", "monolith"},
+		{"/checkout", "monolith"},
+	}
+
+	for _, tc := range testCases {
+		resp, err := http.Get("http://" + httpServer.Addr + tc.path)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "Failed to read response body")
+		assert.Equal(t, tc.expected, string(body), "Unexpected pool for %s", tc.path)
+	}
+
+	// Every pool shows up on the status endpoint.
+	resp, err := http.Get("http://" + httpServer.Addr + "/status")
+	assert.NoError(t, err, "Failed to request status endpoint")
+	defer resp.Body.Close()
+
+	var status proxy.StatusResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status), "Failed to decode status response")
+	assert.Len(t, status.Backends, 1, "Expected the default pool to list the monolith")
+	assert.Len(t, status.Upstreams, 3, "Expected every named pool to be listed")
+	if assert.Len(t, status.Upstreams["api_v2"], 1) {
+		assert.Equal(t, apiV2.Server.URL, status.Upstreams["api_v2"][0].URL, "Unexpected api_v2 backend")
+	}
+}
+
+func TestRouteMatchConditions(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	monolith := helpers.NewMockBackend(200, "monolith", nil, logger)
+	defer monolith.Close()
+
+	v2 := helpers.NewMockBackend(200, "v2", nil, logger)
+	defer v2.Close()
+
+	// Capture the proxy logs to check the access log reports the matched route.
+	core, logs := observer.New(zap.InfoLevel)
+
+	configOverrides := map[string]interface{}{
+		"logger":    zap.New(core),
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"upstreams": map[string]models.PoolConfig{
+			"v2": {Backends: []models.Backend{{URL: v2.Server.URL}}},
+		},
+		"routes": []models.RouteConfig{
+			// Listed first, but routes with conditions on the same prefix are tried before it.
+			{Name: "api", Prefix: "/api"},
+			{
+				Name:     "api-version-2",
+				Prefix:   "/api",
+				Headers:  []models.MatchCondition{{Name: "X-Api-Version", Exact: "2"}},
+				Upstream: "v2",
+			},
+			{
+				Name:     "api-writes",
+				Prefix:   "/api",
+				Methods:  []string{"post", "put"},
+				Headers:  []models.MatchCondition{{Name: "X-Legacy-Client", Absent: true}},
+				Upstream: "v2",
+			},
+			{
+				Name:     "beta",
+				Query:    []models.MatchCondition{{Name: "beta", Exact: "1"}},
+				Upstream: "v2",
+			},
+			{
+				Name:     "tenants",
+				Regex:    "^/tenants/",
+				Headers:  []models.MatchCondition{{Name: "X-Tenant", Regex: "^acme-"}},
+				Query:    []models.MatchCondition{{Name: "view"}},
+				Upstream: "v2",
+			},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{monolith.Server.URL}, configOverrides)
+	defer teardown()
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		headers  map[string]string
+		expected string
+		route    string
+	}{
+		{"plain api request", "GET", "/api/users", nil, "monolith", "api"},
+		{"api version header", "GET", "/api/users", map[string]string{"X-Api-Version": "2"}, "v2", "api-version-2"},
+		{"other api version", "GET", "/api/users", map[string]string{"X-Api-Version": "3"}, "monolith", "api"},
+		{"api write", "POST", "/api/orders", nil, "v2", "api-writes"},
+		{"legacy api write", "POST", "/api/orders", map[string]string{"X-Legacy-Client": "yes"}, "monolith", "api"},
+		{"beta query", "GET", "/home?beta=1", nil, "v2", "beta"},
+		{"beta query off", "GET", "/home?beta=0", nil, "monolith", "default"},
+		{"longer prefix wins over beta", "GET", "/api/users?beta=1", nil, "monolith", "api"},
+		{"tenant with view", "GET", "/tenants/1?view", map[string]string{"X-Tenant": "acme-eu"}, "v2", "tenants"},
+		{"tenant without view", "GET", "/tenants/1", map[string]string{"X-Tenant": "acme-eu"}, "monolith", "default"},
+		{"other tenant", "GET", "/tenants/1?view", map[string]string{"X-Tenant": "globex"}, "monolith", "default"},
+	}
+
+	for _, tc := range testCases {
+		req, err := http.NewRequest(tc.method, "http://"+httpServer.Addr+tc.path, nil)
+		assert.NoError(t, err, "Failed to create request")
+		for key, value := range tc.headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "Failed to read response body")
+		assert.Equal(t, tc.expected, string(body), "Unexpected pool for %s", tc.name)
+
+		// The access log entry is written once the response has been sent, give it a moment.
+		assert.Eventually(t, func() bool {
+			return logs.FilterMessage("Completed request").Len() > 0
+		}, time.Second, 10*time.Millisecond, "Expected an access log entry for %s", tc.name)
+		entries := logs.FilterMessage("Completed request").TakeAll()
+		if assert.Len(t, entries, 1, "Expected one access log entry for %s", tc.name) {
+			assert.Equal(t, tc.route, entries[0].ContextMap()["route"], "Unexpected route logged for %s", tc.name)
+		}
+		logs.TakeAll()
+	}
+}
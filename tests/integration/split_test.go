@@ -0,0 +1,136 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanaryTrafficSplit(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	stable := helpers.NewMockBackend(200, "stable", nil, logger)
+	defer stable.Close()
+
+	canary := helpers.NewMockBackend(200, "canary", nil, logger)
+	defer canary.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 600000, Burst: 10000},
+		"admin":     models.AdminConfig{Token: "admin-secret"},
+		"upstreams": map[string]models.PoolConfig{
+			"canary": {Backends: []models.Backend{{URL: canary.Server.URL}}},
+		},
+		"routes": []models.RouteConfig{
+			{
+				Name:   "api",
+				Prefix: "/api",
+				Split: models.SplitConfig{
+					Canary:         "canary",
+					Weight:         20,
+					OverrideHeader: "X-Canary",
+					OverrideCookie: "canary",
+				},
+			},
+			{
+				Name:   "app",
+				Prefix: "/app",
+				Split: models.SplitConfig{
+					Canary:       "canary",
+					Weight:       50,
+					Sticky:       true,
+					StickyHeader: "X-User-ID",
+				},
+			},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{stable.Server.URL}, configOverrides)
+	defer teardown()
+
+	send := func(method, path string, headers map[string]string, body string) (int, string) {
+		req, err := http.NewRequest(method, "http://"+httpServer.Addr+path, strings.NewReader(body))
+		assert.NoError(t, err, "Failed to create request")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return resp.StatusCode, string(respBody)
+	}
+
+	// Roughly a fifth of the traffic goes to the canary.
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		_, body := send("GET", "/api/items", nil, "")
+		counts[body]++
+	}
+	assert.InDelta(t, 200, counts["canary"], 60, "Expected about 20%% of requests on the canary, got %v", counts)
+
+	// QA can force either side with the header or the cookie.
+	for i := 0; i < 10; i++ {
+		_, body := send("GET", "/api/items", map[string]string{"X-Canary": "canary"}, "")
+		assert.Equal(t, "canary", body, "Expected the header to force the canary")
+		_, body = send("GET", "/api/items", map[string]string{"X-Canary": "stable"}, "")
+		assert.Equal(t, "stable", body, "Expected the header to force stable")
+		_, body = send("GET", "/api/items", map[string]string{"Cookie": "canary=1"}, "")
+		assert.Equal(t, "canary", body, "Expected the cookie to force the canary")
+	}
+
+	// Sticky splits keep every user on one side while still using both.
+	sides := map[string]bool{}
+	for user := 0; user < 20; user++ {
+		headers := map[string]string{"X-User-ID": fmt.Sprintf("user-%d", user)}
+		_, first := send("GET", "/app/home", headers, "")
+		sides[first] = true
+		for i := 0; i < 5; i++ {
+			_, body := send("GET", "/app/home", headers, "")
+			assert.Equal(t, first, body, "Expected user-%d to stay on one side", user)
+		}
+	}
+	assert.Len(t, sides, 2, "Expected users on both sides of a 50/50 split")
+
+	// The weight can be changed at runtime, but only with the admin token.
+	status, _ := send("PUT", "/admin/routes/api/split", nil, `{"weight": 0}`)
+	assert.Equal(t, http.StatusUnauthorized, status, "Expected the admin token to be required")
+
+	admin := map[string]string{"Authorization": "Bearer admin-secret"}
+	status, _ = send("PUT", "/admin/routes/api/split", admin, `{"weight": 150}`)
+	assert.Equal(t, http.StatusBadRequest, status, "Expected out of range weights to be rejected")
+	status, _ = send("PUT", "/admin/routes/missing/split", admin, `{"weight": 5}`)
+	assert.Equal(t, http.StatusNotFound, status, "Expected unknown routes to be rejected")
+
+	status, body := send("PUT", "/admin/routes/api/split", admin, `{"weight": 0}`)
+	assert.Equal(t, http.StatusOK, status, "Expected the weight change to succeed")
+	var split proxy.SplitStatus
+	assert.NoError(t, json.Unmarshal([]byte(body), &split), "Failed to decode split response")
+	assert.Equal(t, 0.0, split.Weight, "Expected the new weight in the response")
+
+	for i := 0; i < 100; i++ {
+		_, body := send("GET", "/api/items", nil, "")
+		assert.Equal(t, "stable", body, "Expected no canary traffic at weight 0")
+	}
+
+	// The status endpoint reports the current weights.
+	_, body = send("GET", "/status", nil, "")
+	var proxyStatus proxy.StatusResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &proxyStatus), "Failed to decode status response")
+	assert.Equal(t, []proxy.SplitStatus{
+		{Route: "api", Stable: "default", Canary: "canary", Weight: 0},
+		{Route: "app", Stable: "default", Canary: "canary", Weight: 50},
+	}, proxyStatus.Splits, "Unexpected splits in status")
+}
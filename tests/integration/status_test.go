@@ -44,4 +44,10 @@ func TestStatusEndpoint(t *testing.T) {
 	assert.Equal(t, "running", statusResp.Status, "Unexpected status value")
 	assert.NotEmpty(t, statusResp.Uptime, "Uptime should not be empty")
 	assert.Equal(t, "1.0.0", statusResp.Version, "Unexpected version value")
+
+	// The status should list the configured backend along with its health.
+	if assert.Len(t, statusResp.Backends, 1, "Expected one backend in status") {
+		assert.Equal(t, backendURL, statusResp.Backends[0].URL, "Unexpected backend URL")
+		assert.True(t, statusResp.Backends[0].Healthy, "Expected backend to be healthy")
+	}
 }
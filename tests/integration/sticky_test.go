@@ -0,0 +1,225 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStickySessions(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Setup two mock backends.
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	backendURLs := []string{backendA.Server.URL, backendB.Server.URL}
+
+	configOverrides := map[string]interface{}{
+		"healthCheckFreq": 500 * time.Millisecond,
+		"sticky": models.StickyConfig{
+			Enabled:    true,
+			CookieName: "affinity",
+			TTL:        time.Hour,
+			Secret:     "test secret",
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, backendURLs, configOverrides)
+	defer teardown()
+
+	proxyURL := "http://" + httpServer.Addr + "/stickytest"
+	send := func(cookie string) (string, *http.Cookie) {
+		headers := map[string]string{}
+		if cookie != "" {
+			headers["Cookie"] = "affinity=" + cookie
+		}
+		resp, err := helpers.SendRequest("GET", proxyURL, headers)
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+
+		for _, c := range resp.Cookies() {
+			if c.Name == "affinity" {
+				return string(body), c
+			}
+		}
+		return string(body), nil
+	}
+
+	// The first request is balanced normally and gets pinned with a cookie.
+	first, cookie := send("")
+	assert.Equal(t, "Response from Backend A", first, "Unexpected backend for first request")
+	if !assert.NotNil(t, cookie, "Expected an affinity cookie") {
+		return
+	}
+	assert.Equal(t, 3600, cookie.MaxAge, "Unexpected cookie max age")
+	assert.True(t, cookie.HttpOnly, "Expected an HttpOnly cookie")
+
+	// Requests carrying the cookie keep going to the same backend, without re-issuing it.
+	for i := 0; i < 4; i++ {
+		body, reissued := send(cookie.Value)
+		assert.Equal(t, first, body, "Expected the pinned backend")
+		assert.Nil(t, reissued, "Cookie should not be re-issued for the pinned backend")
+	}
+
+	// A tampered cookie is ignored and replaced.
+	_, replaced := send(cookie.Value + "x")
+	assert.NotNil(t, replaced, "Expected a fresh cookie for a forged one")
+
+	// Once the pinned backend goes unhealthy the client fails over and is re-pinned.
+	backendA.SetStaticResponse(500, "Unhealthy Backend A", nil)
+	time.Sleep(1500 * time.Millisecond)
+
+	body, failover := send(cookie.Value)
+	assert.Equal(t, "Response from Backend B", body, "Expected failover to the healthy backend")
+	if assert.NotNil(t, failover, "Expected a new cookie after failover") {
+		assert.NotEqual(t, cookie.Value, failover.Value, "Expected the cookie to name the new backend")
+	}
+}
+
+func TestStickySessionExpiry(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	backendA := helpers.NewMockBackend(200, "Response from Backend A", nil, logger)
+	defer backendA.Close()
+
+	backendB := helpers.NewMockBackend(200, "Response from Backend B", nil, logger)
+	defer backendB.Close()
+
+	configOverrides := map[string]interface{}{
+		"sticky": models.StickyConfig{
+			Enabled:    true,
+			CookieName: "affinity",
+			TTL:        2 * time.Second,
+			Secret:     "test secret",
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backendA.Server.URL, backendB.Server.URL}, configOverrides)
+	defer teardown()
+
+	send := func(cookie string) (string, *http.Cookie) {
+		headers := map[string]string{}
+		if cookie != "" {
+			headers["Cookie"] = "affinity=" + cookie
+		}
+		resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/stickytest", headers)
+		assert.NoError(t, err, "Failed to send GET request to proxy")
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		for _, c := range resp.Cookies() {
+			if c.Name == "affinity" {
+				return string(body), c
+			}
+		}
+		return string(body), nil
+	}
+
+	first, cookie := send("")
+	if !assert.NotNil(t, cookie, "Expected an affinity cookie") {
+		return
+	}
+
+	// Past half of its TTL the cookie is refreshed, still naming the same backend.
+	time.Sleep(1100 * time.Millisecond)
+	body, refreshed := send(cookie.Value)
+	assert.Equal(t, first, body, "Expected the pinned backend")
+	if !assert.NotNil(t, refreshed, "Expected the cookie refreshed as it nears expiry") {
+		return
+	}
+	assert.NotEqual(t, cookie.Value, refreshed.Value, "Expected a later expiry in the refreshed cookie")
+
+	// Once expired, a replayed cookie no longer pins and is replaced.
+	time.Sleep(1000 * time.Millisecond)
+	_, replaced := send(cookie.Value)
+	assert.NotNil(t, replaced, "Expected an expired cookie to be rejected and replaced")
+
+	// The refreshed cookie is still honoured.
+	body, _ = send(refreshed.Value)
+	assert.Equal(t, first, body, "Expected the refreshed cookie to keep the pin")
+}
+
+func TestStickySessionsPerPool(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Two backends in the default pool and two in the "api" pool.
+	backends := make([]*helpers.MockBackend, 4)
+	for i, name := range []string{"A", "B", "C", "D"} {
+		backends[i] = helpers.NewMockBackend(200, "Response from Backend "+name, nil, logger)
+		defer backends[i].Close()
+	}
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"sticky": models.StickyConfig{
+			Enabled:    true,
+			CookieName: "affinity",
+			TTL:        time.Hour,
+			Secret:     "test secret",
+		},
+		"upstreams": map[string]models.PoolConfig{
+			"api": {Backends: []models.Backend{
+				{URL: backends[2].Server.URL, Weight: 1},
+				{URL: backends[3].Server.URL, Weight: 1},
+			}},
+		},
+		"routes": []models.RouteConfig{
+			{Name: "api", Prefix: "/api", Upstream: "api"},
+		},
+	}
+
+	// Setup proxy server, the api pool inherits the sticky section.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backends[0].Server.URL, backends[1].Server.URL}, configOverrides)
+	defer teardown()
+
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err, "Failed to create cookie jar")
+	client := &http.Client{Jar: jar}
+	send := func(path string) string {
+		resp, err := client.Get("http://" + httpServer.Addr + path)
+		if !assert.NoError(t, err, "Failed to send GET request to proxy") {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return string(body)
+	}
+
+	// Each pool pins the client with a cookie of its own.
+	home, api := send("/"), send("/api/users")
+	names := []string{}
+	for _, cookie := range jar.Cookies(&url.URL{Scheme: "http", Host: httpServer.Addr, Path: "/"}) {
+		names = append(names, cookie.Name)
+	}
+	assert.ElementsMatch(t, []string{"affinity", "affinity_api"}, names, "Expected one cookie per pool")
+
+	// Alternating between the pools keeps both pins.
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, home, send("/"), "Expected the default pool's pin to survive")
+		assert.Equal(t, api, send("/api/users"), "Expected the api pool's pin to survive")
+	}
+}
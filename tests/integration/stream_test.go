@@ -0,0 +1,197 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamingResponses(t *testing.T) {
+	// gate holds the backend back until the client has seen the previous event.
+	gate := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		switch r.URL.Path {
+		case "/health":
+			w.Write([]byte("OK"))
+		case "/events/gated":
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 1; i <= 3; i++ {
+				fmt.Fprintf(w, "data: event %d\n\n", i)
+				rc.Flush()
+				select {
+				case <-gate:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		case "/events/long":
+			// Lasts well beyond the server write timeout and the upstream timeout.
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			for i := 1; i <= 6; i++ {
+				fmt.Fprintf(w, "data: tick %d\n\n", i)
+				rc.Flush()
+				time.Sleep(150 * time.Millisecond)
+			}
+		case "/chunks/data":
+			// Not an event stream, flushed because of the route's flush interval.
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("first chunk\n"))
+			rc.Flush()
+			select {
+			case <-gate:
+			case <-r.Context().Done():
+				return
+			}
+			w.Write([]byte("second chunk\n"))
+		case "/quiet/events":
+			// Sends one event and then nothing until the proxy gives up on it.
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: hello\n\n"))
+			rc.Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer backend.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit":    models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"readTimeout":  300 * time.Millisecond,
+		"writeTimeout": 300 * time.Millisecond,
+		"routes": []models.RouteConfig{
+			{Prefix: "/chunks", Streaming: models.StreamingConfig{FlushInterval: 20 * time.Millisecond}},
+			{Prefix: "/quiet", Streaming: models.StreamingConfig{IdleTimeout: 300 * time.Millisecond}},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backend.URL}, configOverrides)
+	defer teardown()
+
+	open := func(path string) (*http.Response, *bufio.Reader) {
+		resp, err := http.Get("http://" + httpServer.Addr + path)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	// readLine fails the test instead of hanging when a line is held back by the proxy.
+	readLine := func(reader *bufio.Reader) string {
+		lines := make(chan string, 1)
+		go func() {
+			line, _ := reader.ReadString('\n')
+			lines <- line
+		}()
+		select {
+		case line := <-lines:
+			return strings.TrimSuffix(line, "\n")
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for streamed data")
+			return ""
+		}
+	}
+
+	// Every event reaches the client while the backend is still waiting to send the next one.
+	resp, reader := open("/events/gated")
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"), "Expected the event stream content type")
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, fmt.Sprintf("data: event %d", i), readLine(reader), "Expected event %d before the stream closes", i)
+		assert.Equal(t, "", readLine(reader), "Expected the blank line ending event %d", i)
+		gate <- struct{}{}
+	}
+	rest, err := io.ReadAll(reader)
+	assert.NoError(t, err, "Expected the stream to end cleanly")
+	assert.Empty(t, rest, "Expected nothing after the last event")
+	resp.Body.Close()
+
+	// Streams are not cut off by the write timeout.
+	resp, reader = open("/events/long")
+	var ticks []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			assert.ErrorIs(t, err, io.EOF, "Expected the long stream to end cleanly")
+			break
+		}
+		if strings.HasPrefix(line, "data: ") {
+			ticks = append(ticks, strings.TrimSpace(line))
+		}
+	}
+	resp.Body.Close()
+	assert.Len(t, ticks, 6, "Expected every tick of a stream outliving the write timeout")
+
+	// Routes with a flush interval pass other content types on as they arrive.
+	resp, reader = open("/chunks/data")
+	assert.Equal(t, "first chunk", readLine(reader), "Expected the first chunk before the second is written")
+	gate <- struct{}{}
+	assert.Equal(t, "second chunk", readLine(reader), "Expected the second chunk")
+	resp.Body.Close()
+
+	// A stream that goes quiet is closed after the route's idle timeout.
+	resp, reader = open("/quiet/events")
+	assert.Equal(t, "data: hello", readLine(reader), "Expected the first event")
+	assert.Equal(t, "", readLine(reader), "Expected the blank line ending the event")
+	start := time.Now()
+	_, err = reader.ReadString('\n')
+	assert.Error(t, err, "Expected the idle stream to be closed")
+	assert.InDelta(t, 300, time.Since(start).Milliseconds(), 200, "Expected the stream closed after the idle timeout")
+	resp.Body.Close()
+}
+
+func TestStreamsEndOnShutdown(t *testing.T) {
+	// Sends one event and then holds the stream open for as long as the proxy does.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.Write([]byte("OK"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: hello\n\n"))
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+	}
+
+	// Setup proxy server, torn down by the test itself.
+	httpServer, teardown := helpers.SetupProxy(t, []string{backend.URL}, configOverrides)
+
+	resp, err := http.Get("http://" + httpServer.Addr + "/events")
+	if !assert.NoError(t, err, "Failed to send request to proxy") {
+		teardown()
+		return
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err, "Expected the first event")
+	assert.Equal(t, "data: hello\n", line, "Unexpected first event")
+
+	// Shutting down ends the open stream instead of waiting out the deadline.
+	start := time.Now()
+	teardown()
+	assert.Less(t, time.Since(start), time.Second, "Expected shutdown not to wait on the open stream")
+
+	// The client sees its stream end.
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		ended <- err
+	}()
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the stream to be closed by the shutdown")
+	}
+}
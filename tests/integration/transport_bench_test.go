@@ -0,0 +1,103 @@
+package integration
+
+import (
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// BenchmarkProxyThroughput measures requests per second and allocations through
+// the full proxy against a single fast backend.
+func BenchmarkProxyThroughput(b *testing.B) {
+	logger, err := helpers.NewTestLogger()
+	if err != nil {
+		b.Fatalf("Failed to create test logger: %v", err)
+	}
+
+	backend := helpers.NewMockBackend(200, "throughput", nil, logger)
+	defer backend.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{
+			RequestsPerMinute: 1_000_000_000,
+			Burst:             1_000_000,
+		},
+	}
+
+	httpServer, teardown := helpers.SetupProxy(b, []string{backend.Server.URL}, configOverrides)
+	defer teardown()
+
+	proxyURL := "http://" + httpServer.Addr + "/throughput"
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+	defer client.CloseIdleConnections()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(proxyURL)
+			if err != nil {
+				b.Errorf("Failed to send GET request to proxy: %v", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
+
+// BenchmarkUpstreamClient compares the upstream hop the proxy used to make,
+// with a new client and transport for every request, against one long-lived
+// pooled client per backend as it does now.
+//
+//	go test ./tests/integration -run '^$' -bench BenchmarkUpstreamClient
+func BenchmarkUpstreamClient(b *testing.B) {
+	logger, err := helpers.NewTestLogger()
+	if err != nil {
+		b.Fatalf("Failed to create test logger: %v", err)
+	}
+
+	backend := helpers.NewMockBackend(200, "throughput", nil, logger)
+	defer backend.Close()
+
+	backendURL := backend.Server.URL + "/throughput"
+	send := func(b *testing.B, client *http.Client) {
+		resp, err := client.Get(backendURL)
+		if err != nil {
+			b.Errorf("Failed to send GET request to backend: %v", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	b.Run("per_request_client", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				transport := &http.Transport{MaxIdleConnsPerHost: 100}
+				send(b, &http.Client{Timeout: 5 * time.Second, Transport: transport})
+				// The old path left these idle until they timed out, close them so long runs do not run out of sockets
+				transport.CloseIdleConnections()
+			}
+		})
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+	})
+
+	b.Run("pooled_client", func(b *testing.B) {
+		client := &http.Client{Transport: &http.Transport{MaxIdleConns: 100, MaxIdleConnsPerHost: 100}}
+		defer client.CloseIdleConnections()
+
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				send(b, client)
+			}
+		})
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+	})
+}
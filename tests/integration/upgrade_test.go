@@ -0,0 +1,240 @@
+package integration
+
+import (
+	"encoding/json"
+	"http-reverse-proxy/internal/proxy"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgradeTunnels(t *testing.T) {
+	alpha := helpers.NewUpgradeBackend("alpha")
+	defer alpha.Close()
+
+	beta := helpers.NewUpgradeBackend("beta")
+	defer beta.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"strategy":  "least_connections",
+		"upstream":  models.UpstreamConfig{TunnelIdleTimeout: 500 * time.Millisecond},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{alpha.Server.URL, beta.Server.URL}, configOverrides)
+	defer teardown()
+
+	// echo sends a line through the tunnel and returns the answer.
+	echo := func(conn net.Conn, reader interface{ ReadString(byte) (string, error) }, line string) string {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		_, err := conn.Write([]byte(line + "\n"))
+		assert.NoError(t, err, "Failed to write to tunnel")
+		answer, err := reader.ReadString('\n')
+		assert.NoError(t, err, "Failed to read from tunnel")
+		return strings.TrimSuffix(answer, "\n")
+	}
+
+	// The handshake is relayed and bytes flow both ways.
+	first, firstReader, resp, err := helpers.DialUpgrade(httpServer.Addr, "/chat/room", "echo")
+	assert.NoError(t, err, "Failed to upgrade through the proxy")
+	defer first.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "Expected the upgrade to be accepted")
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"), "Expected the upgrade protocol")
+	assert.Equal(t, "/chat/room", resp.Header.Get("X-Path"), "Expected the backend's handshake headers")
+
+	answer := echo(first, firstReader, "hello")
+	firstBackend, _, _ := strings.Cut(answer, ":")
+	assert.Equal(t, firstBackend+": hello", answer, "Unexpected echo")
+
+	// An open tunnel counts as a connection, so the next one goes to the other backend.
+	second, secondReader, resp, err := helpers.DialUpgrade(httpServer.Addr, "/chat/other", "echo")
+	assert.NoError(t, err, "Failed to upgrade through the proxy")
+	defer second.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "Expected the upgrade to be accepted")
+	secondBackend, _, _ := strings.Cut(echo(second, secondReader, "hi"), ":")
+	assert.NotEqual(t, firstBackend, secondBackend, "Expected the tunnels on different backends")
+
+	statusResp, err := http.Get("http://" + httpServer.Addr + "/status")
+	assert.NoError(t, err, "Failed to get status")
+	var status proxy.StatusResponse
+	assert.NoError(t, json.NewDecoder(statusResp.Body).Decode(&status), "Failed to decode status response")
+	statusResp.Body.Close()
+	for _, backend := range status.Backends {
+		assert.Equal(t, int64(1), backend.InFlight, "Expected one open tunnel on %s", backend.URL)
+	}
+
+	// Closing the client side lets the backend finish its side before the tunnel closes.
+	assert.NoError(t, first.(*net.TCPConn).CloseWrite(), "Failed to half-close the tunnel")
+	first.SetDeadline(time.Now().Add(2 * time.Second))
+	rest, err := io.ReadAll(firstReader)
+	assert.NoError(t, err, "Expected the tunnel to end cleanly")
+	assert.Equal(t, "bye\n", string(rest), "Expected the backend's last words after the half-close")
+
+	// Upgrades the backend turns down are relayed as is.
+	rejected, _, resp, err := helpers.DialUpgrade(httpServer.Addr, "/chat/room", "other")
+	assert.NoError(t, err, "Failed to send upgrade request")
+	rejected.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected the backend's refusal")
+
+	// A tunnel that keeps talking outlives the idle timeout, a quiet one does not.
+	for i := 0; i < 5; i++ {
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, secondBackend+": ping", echo(second, secondReader, "ping"), "Expected a busy tunnel to stay open")
+	}
+	second.SetDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = secondReader.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF, "Expected the idle tunnel to be closed")
+	assert.InDelta(t, 500, time.Since(start).Milliseconds(), 250, "Expected the tunnel closed after the idle timeout")
+	assert.Eventually(t, func() bool {
+		return alpha.Tunnels()+beta.Tunnels() == 0
+	}, 2*time.Second, 20*time.Millisecond, "Expected the backend side of the tunnels to be closed")
+
+	// Shutting down waits for open tunnels, which keep working meanwhile.
+	third, thirdReader, _, err := helpers.DialUpgrade(httpServer.Addr, "/chat/room", "echo")
+	assert.NoError(t, err, "Failed to upgrade through the proxy")
+	defer third.Close()
+	done := make(chan struct{})
+	go func() {
+		teardown()
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("Expected shutdown to wait for the open tunnel")
+	default:
+	}
+	assert.True(t, strings.HasSuffix(echo(third, thirdReader, "still here"), ": still here"), "Expected the tunnel to work while draining")
+
+	third.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected shutdown to finish once the tunnel closed")
+	}
+}
+
+func TestUpgradeLatencyIsHandshake(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Plain requests to the echo backend are answered right away with a 400.
+	echoBackend := helpers.NewUpgradeBackend("echo")
+	defer echoBackend.Close()
+
+	plain := helpers.NewMockBackend(200, "plain", nil, logger)
+	defer plain.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"strategy":  "p2c",
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{echoBackend.Server.URL, plain.Server.URL}, configOverrides)
+	defer teardown()
+
+	// The plain backend is slow once the proxy is up.
+	plain.SetDelay(100 * time.Millisecond)
+
+	// Backends without samples are tried first, so within two requests the plain
+	// backend has answered one and is known to be slow.
+	for i := 0; i < 2; i++ {
+		resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/chat", nil)
+		if !assert.NoError(t, err, "Failed to send GET request to proxy") {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+	}
+
+	// The upgrade goes to the quicker echo backend.
+	conn, reader, resp, err := helpers.DialUpgrade(httpServer.Addr, "/chat", "echo")
+	if !assert.NoError(t, err, "Failed to dial through the proxy") {
+		return
+	}
+	if !assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "Expected the echo backend to take the upgrade") {
+		conn.Close()
+		return
+	}
+
+	// A tunnel that stays open for a second is not a second long response.
+	time.Sleep(time.Second)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite(), "Failed to half-close the tunnel")
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			break
+		}
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Judged by its handshake the echo backend is far quicker than the plain one.
+	for i := 0; i < 5; i++ {
+		resp, err := helpers.SendRequest("GET", "http://"+httpServer.Addr+"/chat", nil)
+		if !assert.NoError(t, err, "Failed to send GET request to proxy") {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected request %d on the echo backend", i)
+	}
+}
+
+func TestUpgradeRouteStats(t *testing.T) {
+	alpha := helpers.NewUpgradeBackend("alpha")
+	defer alpha.Close()
+
+	// The route keeps primary stats for its mirror, which copies nothing.
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"upstreams": map[string]models.PoolConfig{
+			"shadow": {Backends: []models.Backend{{URL: alpha.Server.URL, Weight: 1}}},
+		},
+		"routes": []models.RouteConfig{
+			{Name: "chat", Prefix: "/chat", Mirror: models.MirrorConfig{Upstream: "shadow"}},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{alpha.Server.URL}, configOverrides)
+	defer teardown()
+
+	// One upgrade is accepted and one turned down.
+	conn, _, resp, err := helpers.DialUpgrade(httpServer.Addr, "/chat/room", "echo")
+	if assert.NoError(t, err, "Failed to upgrade through the proxy") {
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "Expected the upgrade to be accepted")
+		defer conn.Close()
+	}
+	rejected, _, resp, err := helpers.DialUpgrade(httpServer.Addr, "/chat/room", "other")
+	if assert.NoError(t, err, "Failed to send upgrade request") {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected the backend's refusal")
+		rejected.Close()
+	}
+
+	// Both handshakes count towards the route, like any other request.
+	statusResp, err := http.Get("http://" + httpServer.Addr + "/status")
+	if !assert.NoError(t, err, "Failed to get status") {
+		return
+	}
+	var status proxy.StatusResponse
+	assert.NoError(t, json.NewDecoder(statusResp.Body).Decode(&status), "Failed to decode status response")
+	statusResp.Body.Close()
+	if assert.Len(t, status.Mirrors, 1, "Expected the route's mirror in the status") {
+		primary := status.Mirrors[0].Primary
+		assert.Equal(t, 2, primary.Requests, "Expected both handshakes to be recorded")
+		assert.Equal(t, map[int]int{101: 1, 400: 1}, primary.Statuses, "Expected the handshake statuses")
+	}
+}
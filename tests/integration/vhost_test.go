@@ -0,0 +1,109 @@
+package integration
+
+import (
+	"crypto/tls"
+	"http-reverse-proxy/pkg/models"
+	"http-reverse-proxy/tests/helpers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	// Initialize logger.
+	logger, err := helpers.NewTestLogger()
+	assert.NoError(t, err, "Failed to create test logger")
+
+	// Unknown hosts end up on the default pool, each domain has a pool of its own.
+	fallback := helpers.NewMockBackend(200, "default", nil, logger)
+	defer fallback.Close()
+
+	shop := helpers.NewMockBackend(200, "shop", nil, logger)
+	defer shop.Close()
+
+	blog := helpers.NewMockBackend(200, "blog", nil, logger)
+	defer blog.Close()
+
+	configOverrides := map[string]interface{}{
+		"ratelimit": models.RateLimitConfig{RequestsPerMinute: 6000, Burst: 100},
+		"upstreams": map[string]models.PoolConfig{
+			"shop": {Backends: []models.Backend{{URL: shop.Server.URL}}},
+			"blog": {Backends: []models.Backend{{URL: blog.Server.URL}}},
+		},
+		"virtualHosts": []models.VirtualHostConfig{
+			{
+				Name:   "shop",
+				Hosts:  []string{"shop.example.com"},
+				Routes: []models.RouteConfig{{Prefix: "/", Upstream: "shop"}},
+			},
+			{
+				Name:   "blog",
+				Hosts:  []string{"*.blog.example.com"},
+				Routes: []models.RouteConfig{{Prefix: "/", Upstream: "blog"}},
+				// The blog gets a much tighter rate limit than everything else.
+				RateLimit: models.RateLimitConfig{RequestsPerMinute: 1, Burst: 1},
+			},
+		},
+	}
+
+	// Setup proxy server.
+	httpServer, teardown := helpers.SetupProxy(t, []string{fallback.Server.URL}, configOverrides)
+	defer teardown()
+
+	send := func(host string) (int, string) {
+		req, err := http.NewRequest("GET", "http://"+httpServer.Addr+"/", nil)
+		assert.NoError(t, err, "Failed to create request")
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Failed to send request to proxy")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Failed to read response body")
+		return resp.StatusCode, string(body)
+	}
+
+	testCases := []struct {
+		host     string
+		expected string
+	}{
+		{"shop.example.com", "shop"},
+		{"SHOP.example.com:8080", "shop"},
+		{"example.com", "default"},
+		{"blog.example.com", "default"},
+		{"unknown.test", "default"},
+		{"alice.blog.example.com", "blog"},
+	}
+
+	for _, tc := range testCases {
+		status, body := send(tc.host)
+		assert.Equal(t, 200, status, "Unexpected status for %s", tc.host)
+		assert.Equal(t, tc.expected, body, "Unexpected pool for %s", tc.host)
+	}
+
+	// The blog's own rate limit kicks in while the other hosts keep working.
+	status, _ := send("bob.blog.example.com")
+	assert.Equal(t, http.StatusTooManyRequests, status, "Expected the blog rate limit to apply")
+	status, body := send("shop.example.com")
+	assert.Equal(t, 200, status, "Expected the shop to be unaffected")
+	assert.Equal(t, "shop", body, "Unexpected pool for shop.example.com")
+
+	// Over TLS the server name picks the virtual host when no Host header is sent...
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = ""
+	req.TLS = &tls.ConnectionState{ServerName: "shop.example.com"}
+	rec := httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code, "Expected SNI to select the virtual host")
+	assert.Equal(t, "shop", rec.Body.String(), "Unexpected pool for SNI shop.example.com")
+
+	// ...and a Host header for another virtual host than the server name is refused.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = "alice.blog.example.com"
+	req.TLS = &tls.ConnectionState{ServerName: "shop.example.com"}
+	rec = httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMisdirectedRequest, rec.Code, "Expected mismatched SNI to be rejected")
+}